@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// parseNetworks parses CIDR ranges, single addresses are treated as a range of one address.
+func parseNetworks(values []string) ([]netip.Prefix, error) {
+	networks := make([]netip.Prefix, 0, len(values))
+
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q", value)
+			}
+
+			// an IPv4-mapped range matches the IPv4 addresses, the addresses are unmapped before the check
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+
+			networks = append(networks, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", value)
+		}
+
+		networks = append(networks, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	return networks, nil
+}
+
+// loadNetworksFile reads published hook ranges. JSON files may be the meta API response of GitHub with the
+// ranges in "hooks" or a plain array, other files contain one range per line and # comments.
+func loadNetworksFile(file string) ([]netip.Prefix, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		if trimmed[0] == '{' {
+			var meta struct {
+				Hooks []string `json:"hooks"`
+			}
+
+			if err := json.Unmarshal(trimmed, &meta); err != nil {
+				return nil, err
+			}
+
+			values = meta.Hooks
+		} else if err := json.Unmarshal(trimmed, &values); err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				values = append(values, line)
+			}
+		}
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%s contains no networks", file)
+	}
+
+	return parseNetworks(values)
+}
+
+func networksContain(networks []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsIP checks the allowed_ips of the user, users without a list are allowed from everywhere.
+func (c ConfigUser) AllowsIP(ip string) bool {
+	return len(c.allowedNetworks) == 0 || networksContain(c.allowedNetworks, ip)
+}
+
+// AllowsIP checks the allowed_ips and allowed_ips_file of the provider.
+func (p ConfigProvider) AllowsIP(ip string) bool {
+	return len(p.allowedNetworks) == 0 || networksContain(p.allowedNetworks, ip)
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only honoured when the request comes from
+// a trusted proxy, the client is the last address in the chain that is not a trusted proxy itself.
+func clientIP(r *http.Request) string {
+	config := app.Config()
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if len(config.trustedProxies) == 0 || !networksContain(config.trustedProxies, host) {
+		return host
+	}
+
+	var chain []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(header, ",") {
+			chain = append(chain, strings.TrimSpace(address))
+		}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if _, err := netip.ParseAddr(chain[i]); err != nil {
+			break
+		}
+
+		host = chain[i]
+
+		if !networksContain(config.trustedProxies, host) {
+			break
+		}
+	}
+
+	return host
+}
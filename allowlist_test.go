@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNetworksContain(t *testing.T) {
+	networks, err := parseNetworks([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::ffff:198.51.100.0/120"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::ffff:10.1.2.3", true},
+		{"::ffff:11.0.0.1", false},
+		{"198.51.100.7", true},
+		{"::ffff:198.51.100.7", true},
+		{"", false},
+		{"not-an-ip", false},
+		{"10.0.0.1:8080", false},
+		{"10.0.0.256", false},
+	}
+
+	for _, test := range tests {
+		if got := networksContain(networks, test.ip); got != test.want {
+			t.Errorf("networksContain(%q) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestParseNetworksInvalid(t *testing.T) {
+	for _, value := range []string{"10.0.0.0/33", "10.0.0/8", "example.com", "2001:db8::/129", ""} {
+		if _, err := parseNetworks([]string{value}); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	previousApp := app
+	t.Cleanup(func() { app = previousApp })
+
+	trustedProxies, err := parseNetworks([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		trustedProxies bool
+		remoteAddr     string
+		forwardedFor   []string
+		want           string
+	}{
+		{"no proxy", true, "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"header ignored without trusted proxies", false, "10.0.0.1:1234", []string{"198.51.100.7"}, "10.0.0.1"},
+		{"spoofed header from untrusted peer", true, "203.0.113.5:1234", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"trusted proxy", true, "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"several proxies", true, "10.0.0.1:1234", []string{"198.51.100.7, 10.0.0.2, 10.0.0.3"}, "198.51.100.7"},
+		{"spoofed address in front of the chain", true, "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"several headers", true, "10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"only proxies", true, "10.0.0.1:1234", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"invalid last entry", true, "10.0.0.1:1234", []string{"198.51.100.7, unknown"}, "10.0.0.1"},
+		{"invalid entry in front of a proxy", true, "10.0.0.1:1234", []string{"garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"address with port", true, "10.0.0.1:1234", []string{"198.51.100.7:443"}, "10.0.0.1"},
+		{"mapped remote address", true, "[::ffff:10.0.0.1]:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"mapped proxy in the chain", true, "10.0.0.1:1234", []string{"198.51.100.7, ::ffff:10.0.0.2"}, "198.51.100.7"},
+		{"ipv6 proxy", true, "[fd00::1]:1234", []string{"2001:db8::7"}, "2001:db8::7"},
+		{"remote address without port", true, "203.0.113.5", []string{"198.51.100.7"}, "203.0.113.5"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{}
+			if test.trustedProxies {
+				config.trustedProxies = trustedProxies
+			}
+
+			app = &App{}
+			app.state.Store(&appState{config: config})
+
+			request := httptest.NewRequest(http.MethodGet, "/packages.json", nil)
+			request.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwardedFor {
+				request.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := clientIP(request); got != test.want {
+				t.Errorf("clientIP() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
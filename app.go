@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-co-op/gocron/v2"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// errSyncRunning is returned when a sync of the provider is already running, the running one fetches
+// everything anyway.
+var errSyncRunning = errors.New("a sync of the provider is already running")
+
+// errWebhookSecret is returned by webhooks whose secret or signature does not match.
+var errWebhookSecret = errors.New("the webhook secret does not match")
+
+// errWebhookQueued is returned by webhooks received while their provider is synced, the push is applied
+// after the sync.
+var errWebhookQueued = errors.New("the webhook is applied after the running sync")
+
+// App holds the state of the registry. The config, the providers and their cron jobs are replaced together
+// when a config is applied, so readers never see the providers of another config.
+type App struct {
+	db *bolt.DB
+
+	state atomic.Pointer[appState]
+
+	// applyLock serializes applying configs, the cron jobs run with ctx
+	applyLock sync.Mutex
+	ctx       context.Context
+	scheduler gocron.Scheduler
+
+	// syncLocks holds a *sync.Mutex per provider name, a provider is only synced once at a time
+	syncLocks sync.Map
+
+	// webhookQueues holds a *webhookQueue per provider name
+	webhookQueues sync.Map
+}
+
+// webhookQueue keeps the pushes received while the provider is synced, so a webhook neither waits for the
+// sync nor is overwritten by the refs the sync fetched before the push. Pushes outside of a sync are applied
+// right away, a sync waits for them before it starts.
+type webhookQueue struct {
+	sync.Mutex
+	applied  *sync.Cond
+	syncing  bool
+	applying int
+	pending  []func(context.Context) error
+}
+
+// appState is never changed after it was stored, a new config stores a new state.
+type appState struct {
+	config    *Config
+	providers map[string]TypeProvider
+	cronJobs  map[string]gocron.Job
+}
+
+var app = &App{}
+
+// current returns the config and the providers of the same state, for callers needing both.
+func (a *App) current() *appState {
+	return a.state.Load()
+}
+
+// Config returns the current config, it must not be changed.
+func (a *App) Config() *Config {
+	return a.state.Load().config
+}
+
+func (a *App) Provider(name string) (TypeProvider, bool) {
+	provider, ok := a.state.Load().providers[name]
+
+	return provider, ok
+}
+
+// Providers returns the providers of the current config, the map must not be changed.
+func (a *App) Providers() map[string]TypeProvider {
+	return a.state.Load().providers
+}
+
+func (a *App) CronJob(name string) (gocron.Job, bool) {
+	job, ok := a.state.Load().cronJobs[name]
+
+	return job, ok
+}
+
+func (a *App) syncLock(name string) *sync.Mutex {
+	lock, _ := a.syncLocks.LoadOrStore(name, &sync.Mutex{})
+
+	return lock.(*sync.Mutex)
+}
+
+func (a *App) webhookQueue(name string) *webhookQueue {
+	queue := &webhookQueue{}
+	queue.applied = sync.NewCond(queue)
+
+	existing, _ := a.webhookQueues.LoadOrStore(name, queue)
+
+	return existing.(*webhookQueue)
+}
+
+// applyWebhook applies a push of the provider with ctx, or queues it and returns errWebhookQueued when the
+// provider is synced.
+func (a *App) applyWebhook(ctx context.Context, name string, apply func(context.Context) error) error {
+	queue := a.webhookQueue(name)
+
+	queue.Lock()
+	if queue.syncing {
+		queue.pending = append(queue.pending, apply)
+		queue.Unlock()
+
+		return errWebhookQueued
+	}
+
+	queue.applying++
+	queue.Unlock()
+
+	defer func() {
+		queue.Lock()
+		queue.applying--
+		queue.applied.Broadcast()
+		queue.Unlock()
+	}()
+
+	return apply(ctx)
+}
+
+// hold waits for the pushes being applied, later ones are queued until release.
+func (q *webhookQueue) hold() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.syncing = true
+	for q.applying > 0 {
+		q.applied.Wait()
+	}
+}
+
+// release applies the queued pushes with the context of the sync, the webhook requests are already answered.
+func (q *webhookQueue) release(ctx context.Context, name string) {
+	for {
+		q.Lock()
+		pending := q.pending
+		q.pending = nil
+
+		if len(pending) == 0 {
+			q.syncing = false
+			q.Unlock()
+
+			return
+		}
+
+		q.Unlock()
+
+		for _, apply := range pending {
+			if err := apply(ctx); err != nil {
+				log.WithContext(ctx).WithField("provider", name).WithError(err).Error("cannot apply queued webhook")
+			}
+		}
+	}
+}
+
+// start applies the config and schedules the syncs of its providers with ctx, the returned scheduler has to
+// be shut down.
+func (a *App) start(ctx context.Context, config *Config) (gocron.Scheduler, error) {
+	scheduler, err := gocron.NewScheduler()
+	if err != nil {
+		return nil, err
+	}
+
+	a.applyLock.Lock()
+	a.ctx = ctx
+	a.scheduler = scheduler
+	a.applyLock.Unlock()
+
+	if _, err := a.apply(config); err != nil {
+		return nil, err
+	}
+
+	scheduler.Start()
+
+	return scheduler, nil
+}
+
+// reload loads the config file again and applies it. An invalid config or provider keeps the current config
+// running.
+func (a *App) reload() (ProviderChanges, error) {
+	next, err := LoadConfig()
+	if err != nil {
+		return ProviderChanges{}, err
+	}
+
+	changes, err := a.apply(next)
+	if err != nil {
+		return ProviderChanges{}, err
+	}
+
+	if err := setupLogging(next.Log); err != nil {
+		log.WithError(err).Error("cannot apply log config")
+	}
+
+	for _, name := range changes.Removed {
+		forgetProviderStatus(name)
+	}
+
+	log.WithFields(log.Fields{"added": changes.Added, "updated": changes.Updated, "removed": changes.Removed}).Info("reloaded config")
+
+	return changes, nil
+}
+
+// apply replaces the config and the providers. Unchanged providers and cron jobs are kept, so running syncs
+// are not affected. When a provider cannot be created or scheduled, nothing is changed.
+func (a *App) apply(next *Config) (ProviderChanges, error) {
+	a.applyLock.Lock()
+	defer a.applyLock.Unlock()
+
+	current := a.state.Load()
+	if current == nil {
+		current = &appState{providers: map[string]TypeProvider{}, cronJobs: map[string]gocron.Job{}}
+	}
+
+	changes := ProviderChanges{Added: []string{}, Updated: []string{}, Removed: []string{}}
+	nextState := &appState{config: next, providers: make(map[string]TypeProvider), cronJobs: make(map[string]gocron.Job)}
+	var scheduled []gocron.Job
+
+	// removes the jobs scheduled by this call when a later provider fails
+	rollback := func() {
+		for _, job := range scheduled {
+			a.scheduler.RemoveJob(job.ID())
+		}
+	}
+
+	for _, provider := range next.Providers {
+		existing, exists := current.providers[provider.Name]
+
+		if exists && reflect.DeepEqual(existing.GetConfig(), provider) {
+			nextState.providers[provider.Name] = existing
+			if job, ok := current.cronJobs[provider.Name]; ok {
+				nextState.cronJobs[provider.Name] = job
+			}
+
+			continue
+		}
+
+		created, err := newProvider(provider)
+		if err != nil {
+			rollback()
+			return ProviderChanges{}, fmt.Errorf("provider %s: %w", provider.Name, err)
+		}
+
+		nextState.providers[provider.Name] = created
+
+		if exists {
+			changes.Updated = append(changes.Updated, provider.Name)
+		} else {
+			changes.Added = append(changes.Added, provider.Name)
+		}
+
+		// the job looks up the provider by name when it runs, it only has to change with the schedule
+		if job, ok := current.cronJobs[provider.Name]; ok && existing.GetConfig().CronSchedule == provider.CronSchedule {
+			nextState.cronJobs[provider.Name] = job
+			continue
+		}
+
+		if provider.CronSchedule == "" {
+			continue
+		}
+
+		job, err := a.scheduler.NewJob(
+			gocron.CronJob(provider.CronSchedule, false),
+			gocron.NewTask(syncProvider, a.ctx, provider.Name),
+			gocron.WithTags(provider.Name),
+		)
+
+		if err != nil {
+			rollback()
+			return ProviderChanges{}, fmt.Errorf("provider %s: cannot schedule sync: %w", provider.Name, err)
+		}
+
+		scheduled = append(scheduled, job)
+		nextState.cronJobs[provider.Name] = job
+	}
+
+	for name := range current.providers {
+		if _, ok := nextState.providers[name]; !ok {
+			changes.Removed = append(changes.Removed, name)
+		}
+	}
+
+	if current.config != nil {
+		for _, option := range keepStartupOptions(current.config, next) {
+			log.WithField("option", option).Warn("config: the option changed, it is applied after a restart")
+		}
+	}
+
+	a.state.Store(nextState)
+
+	for name, job := range current.cronJobs {
+		if replacement, ok := nextState.cronJobs[name]; !ok || replacement.ID() != job.ID() {
+			a.scheduler.RemoveJob(job.ID())
+		}
+	}
+
+	return changes, nil
+}
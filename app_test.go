@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// loadTestConfig writes the config to a file in dir and loads it like the registry does on a reload.
+func loadTestConfig(t *testing.T, dir string, name string, content string) *Config {
+	t.Helper()
+
+	configFile = path.Join(dir, name)
+	if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return config
+}
+
+// TestReloadWhileServing applies configs while requests are served and providers are synced, run it with
+// -race to find state that is read without the config lock.
+func TestReloadWhileServing(t *testing.T) {
+	dir := t.TempDir()
+	previousApp, previousConfigFile := app, configFile
+	t.Cleanup(func() { app, configFile = previousApp, previousConfigFile })
+
+	app = &App{}
+
+	configs := []*Config{
+		loadTestConfig(t, dir, "a.json", fmt.Sprintf(`{
+			"base_url": "http://localhost",
+			"storage_path": %q,
+			"users": [{"token": "reader"}],
+			"providers": [
+				{"name": "custom", "type": "custom"},
+				{"name": "scheduled", "type": "custom", "cron_schedule": "* * * * *"}
+			]
+		}`, dir)),
+		loadTestConfig(t, dir, "b.json", fmt.Sprintf(`{
+			"base_url": "http://localhost",
+			"storage_path": %q,
+			"users": [{"token": "reader"}, {"token": "other", "rules": [{"type": "vendor", "value": "acme"}]}],
+			"providers": [
+				{"name": "custom", "type": "custom", "allowed_ips": ["127.0.0.1"]},
+				{"name": "scheduled", "type": "custom", "cron_schedule": "*/5 * * * *"},
+				{"name": "added", "type": "custom"}
+			]
+		}`, dir)),
+	}
+
+	db, err := bolt.Open(path.Join(dir, "packages.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+	app.db = db
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("packages"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	scheduler, err := app.start(ctx, configs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer scheduler.Shutdown()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 50; i++ {
+			if _, err := app.apply(configs[i%2]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				request := httptest.NewRequest(http.MethodGet, "/packages.json", nil)
+				request.Header.Set("Authorization", "Bearer reader")
+
+				recorder := httptest.NewRecorder()
+				packagesJsonHandler(recorder, request, nil)
+
+				if recorder.Code != http.StatusOK {
+					t.Errorf("expected status 200, got %d", recorder.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 50; i++ {
+			updateAll(ctx, true)
+
+			for name := range app.Providers() {
+				app.CronJob(name)
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+func TestWebhookQueuedDuringSync(t *testing.T) {
+	previousApp := app
+	t.Cleanup(func() { app = previousApp })
+
+	app = &App{}
+	queue := app.webhookQueue("github")
+
+	var applied []string
+	push := func(ref string) func(context.Context) error {
+		return func(ctx context.Context) error {
+			applied = append(applied, ref)
+			return nil
+		}
+	}
+
+	if err := app.applyWebhook(context.Background(), "github", push("main")); err != nil {
+		t.Fatalf("expected the push to be applied outside of a sync, got %v", err)
+	}
+
+	queue.hold()
+
+	if err := app.applyWebhook(context.Background(), "github", push("1.0.0")); !errors.Is(err, errWebhookQueued) {
+		t.Fatalf("expected the push to be queued during a sync, got %v", err)
+	}
+
+	if len(applied) != 1 {
+		t.Fatalf("expected the queued push not to be applied during the sync, got %v", applied)
+	}
+
+	queue.release(context.Background(), "github")
+
+	if want := []string{"main", "1.0.0"}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied %v, want %v", applied, want)
+	}
+
+	if err := app.applyWebhook(context.Background(), "github", push("1.0.1")); err != nil {
+		t.Errorf("expected the push to be applied after the sync, got %v", err)
+	}
+}
+
+func TestSyncWaitsForAppliedWebhook(t *testing.T) {
+	previousApp := app
+	t.Cleanup(func() { app = previousApp })
+
+	app = &App{}
+	queue := app.webhookQueue("github")
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	go app.applyWebhook(context.Background(), "github", func(ctx context.Context) error {
+		close(started)
+		<-finish
+		return nil
+	})
+
+	<-started
+
+	held := make(chan struct{})
+	go func() {
+		queue.hold()
+		close(held)
+	}()
+
+	select {
+	case <-held:
+		t.Fatal("the sync started while a webhook was applied")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(finish)
+	<-held
+	queue.release(context.Background(), "github")
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+
+	// entries are queued and committed in batches, a full queue makes requests wait for the writer
+	auditQueueSize = 4096
+	auditBatchSize = 256
+)
+
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Action    string    `json:"action"`
+	Identity  string    `json:"identity,omitempty"`
+	IP        string    `json:"ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Package   string    `json:"package,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+}
+
+type auditContextKey struct{}
+
+var auditFile = struct {
+	sync.Mutex
+	file *os.File
+}{}
+
+// auditWriter commits queued entries to the database in the background, so requests do not wait for a
+// commit. Entries are rejected once it is stopped.
+var auditWriter = struct {
+	sync.RWMutex
+	entries chan *auditRecord
+	done    chan struct{}
+	stopped bool
+}{}
+
+type auditRecord struct {
+	time time.Time
+	data []byte
+}
+
+// openAuditLog starts the database writer and opens the configured JSON lines file, entries are only ever
+// appended to it. The writer always runs, audit can be enabled by a reload.
+func openAuditLog(config ConfigAudit) error {
+	auditWriter.entries = make(chan *auditRecord, auditQueueSize)
+	auditWriter.done = make(chan struct{})
+	go runAuditWriter(auditWriter.entries, auditWriter.done)
+
+	if !config.Enabled || config.File == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	auditFile.file = file
+
+	return nil
+}
+
+// closeAuditLog commits the queued entries, and flushes and closes the audit file on shutdown.
+func closeAuditLog() error {
+	auditWriter.Lock()
+	if auditWriter.entries != nil && !auditWriter.stopped {
+		auditWriter.stopped = true
+		close(auditWriter.entries)
+	}
+	auditWriter.Unlock()
+
+	if auditWriter.done != nil {
+		<-auditWriter.done
+	}
+
+	auditFile.Lock()
+	defer auditFile.Unlock()
+
+	if auditFile.file == nil {
+		return nil
+	}
+
+	err := auditFile.file.Sync()
+	if closeErr := auditFile.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	auditFile.file = nil
+
+	return err
+}
+
+// audited records every request of the handler in the audit log. Handlers complete the entry with the
+// identity and the package they resolved, see setRequestUser and auditPackage.
+func audited(action string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !app.Config().Audit.Enabled {
+			handle(w, r, ps)
+			return
+		}
+
+		entry := &AuditEntry{
+			Time:      time.Now().UTC(),
+			RequestID: requestID(r.Context()),
+			Action:    action,
+			IP:        clientIP(r),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Package:   packageFromParams(ps),
+			Version:   ps.ByName("version"),
+			Target:    ps.ByName("id"),
+		}
+
+		counter := &countingResponseWriter{ResponseWriter: w}
+		handle(counter, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, entry)), ps)
+
+		entry.Status = counter.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+
+		entry.Outcome = auditOutcome(entry.Status)
+
+		if err := writeAuditEntry(entry); err != nil {
+			log.WithContext(r.Context()).WithError(err).Error("cannot write audit log")
+		}
+	}
+}
+
+func packageFromParams(ps httprouter.Params) string {
+	owner, repo := ps.ByName("owner"), ps.ByName("repo")
+	if owner == "" || repo == "" {
+		return ""
+	}
+
+	return owner + "/" + repo
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return "success"
+	case status == http.StatusUnauthorized:
+		return "unauthorized"
+	case status == http.StatusForbidden:
+		return "forbidden"
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status == http.StatusTooManyRequests:
+		return "rate_limited"
+	case status < http.StatusInternalServerError:
+		return "rejected"
+	}
+
+	return "error"
+}
+
+func auditEntryOf(r *http.Request) *AuditEntry {
+	entry, _ := r.Context().Value(auditContextKey{}).(*AuditEntry)
+
+	return entry
+}
+
+func auditPackage(r *http.Request, packageName, version string) {
+	if entry := auditEntryOf(r); entry != nil {
+		entry.Package = packageName
+		entry.Version = version
+	}
+}
+
+// auditStoredVersion records the package and the version stored under infoKey, for webhooks which only know
+// the repository. Queued webhooks are applied with the context of the sync and are not recorded.
+func auditStoredVersion(ctx context.Context, tx *bolt.Tx, infoKey string) {
+	entry, _ := ctx.Value(auditContextKey{}).(*AuditEntry)
+	if entry == nil {
+		return
+	}
+
+	key := tx.Bucket([]byte("packages")).Get([]byte("info--" + infoKey))
+
+	if name, version, ok := strings.Cut(strings.TrimPrefix(string(key), "packages--"), "|"); ok {
+		entry.Package = name
+		entry.Version = version
+	}
+}
+
+func auditTarget(r *http.Request, target string) {
+	if entry := auditEntryOf(r); entry != nil {
+		entry.Target = target
+	}
+}
+
+// Identity names the user in the audit log without revealing its secrets.
+func (c ConfigUser) Identity() string {
+	switch {
+	case c.anonymous:
+		return "anonymous"
+	case c.identity != "":
+		return c.identity
+	case c.Username != "":
+		return "user:" + c.Username
+	case c.Token != "":
+		return "user:" + secretFingerprint(c.Token)
+	case c.TokenHash == "" && len(c.ClientCertificates) > 0:
+		return "certificate:" + c.ClientCertificates[0]
+	}
+
+	return "user:" + secretFingerprint(c.TokenHash)
+}
+
+// fingerprintKey keys the fingerprints of secrets, so a fingerprint in the logs cannot be used to guess the
+// secret offline. It is stored in the database, so fingerprints stay the same across restarts.
+var fingerprintKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return key
+}()
+
+func secretFingerprint(secret string) string {
+	mac := hmac.New(sha256.New, fingerprintKey)
+	mac.Write([]byte(secret))
+
+	return hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// loadFingerprintKey reads the fingerprint key of this instance, or stores the generated one.
+func loadFingerprintKey(tx *bolt.Tx) error {
+	bucket := tx.Bucket([]byte("meta"))
+
+	if key := bucket.Get([]byte("fingerprint_key")); len(key) > 0 {
+		fingerprintKey = append([]byte(nil), key...)
+		return nil
+	}
+
+	return bucket.Put([]byte("fingerprint_key"), fingerprintKey)
+}
+
+func writeAuditEntry(entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	auditFile.Lock()
+	if auditFile.file != nil {
+		_, err = auditFile.file.Write(append(data, '\n'))
+	}
+	auditFile.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	auditWriter.RLock()
+	defer auditWriter.RUnlock()
+
+	if auditWriter.entries == nil || auditWriter.stopped {
+		return fmt.Errorf("the audit log is closed")
+	}
+
+	auditWriter.entries <- &auditRecord{time: entry.Time, data: data}
+
+	return nil
+}
+
+// runAuditWriter commits the queued entries, all entries waiting in the queue are committed together.
+func runAuditWriter(entries <-chan *auditRecord, done chan<- struct{}) {
+	defer close(done)
+
+	for record := range entries {
+		batch := []*auditRecord{record}
+
+	collect:
+		for len(batch) < auditBatchSize {
+			select {
+			case next, ok := <-entries:
+				if !ok {
+					break collect
+				}
+
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+
+		if err := storeAuditRecords(batch); err != nil {
+			log.WithError(err).WithField("entries", len(batch)).Error("cannot write audit log")
+		}
+	}
+}
+
+func storeAuditRecords(records []*auditRecord) error {
+	return app.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("audit"))
+
+		for _, record := range records {
+			timestamp := uint64(record.time.UnixNano())
+
+			// keys must be unique, even when two requests finish at the same time
+			if last, _ := bucket.Cursor().Last(); last != nil {
+				if lastTimestamp := binary.BigEndian.Uint64(last); lastTimestamp >= timestamp {
+					timestamp = lastTimestamp + 1
+				}
+			}
+
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, timestamp)
+
+			if err := bucket.Put(key, record.data); err != nil {
+				return err
+			}
+		}
+
+		return pruneAuditLog(bucket, records[len(records)-1].time)
+	})
+}
+
+func pruneAuditLog(bucket *bolt.Bucket, now time.Time) error {
+	config := app.Config()
+
+	if config.Audit.RetentionDays <= 0 {
+		return nil
+	}
+
+	oldest := uint64(now.AddDate(0, 0, -config.Audit.RetentionDays).UnixNano())
+
+	c := bucket.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < oldest; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func registerAuditHandlers(router *Router) {
+	router.GET("/admin/audit", audited("admin", throttledAuth(auditLogHandler)))
+}
+
+// auditLogHandler returns the newest entries first. All filters except since and until have to match
+// exactly.
+func auditLogHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !validateAdminRequest(r) {
+		unauthorized(w)
+		return
+	}
+
+	query := r.URL.Query()
+	filters := map[string]string{}
+	for _, name := range []string{"action", "identity", "ip", "package", "version", "target", "outcome"} {
+		if value := query.Get(name); value != "" {
+			filters[name] = value
+		}
+	}
+
+	var since, until time.Time
+	for name, target := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s, expected RFC3339 time", name), http.StatusBadRequest)
+				return
+			}
+
+			*target = parsed
+		}
+	}
+
+	limit := auditDefaultLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+
+		limit = min(parsed, auditMaxLimit)
+	}
+
+	entries := make([]AuditEntry, 0)
+
+	err := app.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("audit")).Cursor()
+
+		k, v := c.Last()
+		if !until.IsZero() {
+			start := make([]byte, 8)
+			binary.BigEndian.PutUint64(start, uint64(until.UnixNano())+1)
+
+			if k, v = c.Seek(start); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+
+		for ; k != nil && len(entries) < limit; k, v = c.Prev() {
+			if !since.IsZero() && binary.BigEndian.Uint64(k) < uint64(since.UnixNano()) {
+				break
+			}
+
+			var entry AuditEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+
+			if entry.matches(filters) {
+				entries = append(entries, entry)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithContext(r.Context()).Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": entries})
+}
+
+func (e AuditEntry) matches(filters map[string]string) bool {
+	values := map[string]string{
+		"action":   e.Action,
+		"identity": e.Identity,
+		"ip":       e.IP,
+		"package":  e.Package,
+		"version":  e.Version,
+		"target":   e.Target,
+		"outcome":  e.Outcome,
+	}
+
+	for name, value := range filters {
+		if values[name] != value {
+			return false
+		}
+	}
+
+	return true
+}
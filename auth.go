@@ -1,25 +1,249 @@
 package main
 
 import (
+	"crypto/sha256"
 	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"slices"
 	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	scopeRead     = "read"
+	scopeDownload = "download"
+	scopePublish  = "publish"
+	scopeDelete   = "delete"
+	scopeAdmin    = "admin"
 )
 
+// Users without configured scopes can read metadata and download dists.
+var defaultScopes = []string{scopeRead, scopeDownload}
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		switch scope {
+		case scopeRead, scopeDownload, scopePublish, scopeDelete, scopeAdmin:
+		default:
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	return nil
+}
+
+// HasScope checks the scopes of the user. When authentication is disabled, everything except the admin
+// API is allowed.
+func (c ConfigUser) HasScope(scope string) bool {
+	if c.anonymous {
+		return scope != scopeAdmin
+	}
+
+	if len(c.Scopes) == 0 {
+		return slices.Contains(defaultScopes, scope)
+	}
+
+	return slices.Contains(c.Scopes, scope)
+}
+
+// validateRequest returns the user of the request, users outside of their allowed_ips are rejected before
+// any rule is evaluated.
 func validateRequest(r *http.Request) *ConfigUser {
-	if len(config.Users) == 0 {
-		return &ConfigUser{Rules: make([]ConfigUserRule, 0)}
+	info := requestInfoOf(r.Context())
+	if info != nil && info.authenticated {
+		return info.user
+	}
+
+	user := findRequestUser(r)
+
+	if user != nil && !user.AllowsIP(clientIP(r)) {
+		log.WithContext(r.Context()).WithFields(log.Fields{"user": user.Identity(), "ip": clientIP(r)}).Info("rejected request, the address is not in allowed_ips")
+		setRequestUser(r, user)
+
+		user = nil
+	}
+
+	if info != nil {
+		info.user, info.authenticated = user, true
+	}
+
+	return user
+}
+
+func findRequestUser(r *http.Request) *ConfigUser {
+	config := app.Config()
+
+	if len(config.Users) == 0 && len(config.OIDC) == 0 && !hasDatabaseTokens() {
+		return &ConfigUser{Rules: make([]ConfigUserRule, 0), anonymous: true}
+	}
+
+	if r.Header.Get("Authorization") == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return findUserByCertificate(r.TLS.VerifiedChains[0][0])
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		return findUserByBasicAuth(username, password)
+	}
+
+	token := bearerToken(r)
+
+	if len(config.OIDC) > 0 && looksLikeJWT(token) {
+		return validateJWT(token)
 	}
 
-	token := []byte(strings.TrimPrefix(strings.TrimPrefix(r.Header.Get("authorization"), "bearer "), "Bearer "))
+	found := findUserByToken(config, token)
+
+	if found == nil {
+		if dbToken := findDatabaseToken(token); dbToken != nil {
+			found = dbToken.User()
+		}
+	}
+
+	return found
+}
+
+// indexUserTokens maps the SHA-256 of plain tokens and of sha256: hashes to their user, so a bearer token is
+// found without checking every user. Only users with bcrypt or argon2id hashes are checked one by one.
+func indexUserTokens(config *Config) {
+	config.userTokens = make(map[[sha256.Size]byte]int)
+	config.slowHashUsers = nil
+
+	for i, user := range config.Users {
+		var sum [sha256.Size]byte
+
+		switch {
+		case user.TokenHash == "" && user.Token != "":
+			sum = sha256.Sum256([]byte(user.Token))
+		case strings.HasPrefix(user.TokenHash, "sha256:"):
+			expected, err := hex.DecodeString(strings.TrimPrefix(user.TokenHash, "sha256:"))
+			if err != nil || len(expected) != sha256.Size {
+				continue
+			}
+
+			sum = [sha256.Size]byte(expected)
+		case user.TokenHash != "":
+			config.slowHashUsers = append(config.slowHashUsers, i)
+			continue
+		default:
+			continue
+		}
 
+		if _, ok := config.userTokens[sum]; !ok {
+			config.userTokens[sum] = i
+		}
+	}
+}
+
+func findUserByToken(config *Config, token string) *ConfigUser {
+	if token == "" {
+		return nil
+	}
+
+	if i, ok := config.userTokens[sha256.Sum256([]byte(token))]; ok {
+		user := config.Users[i]
+		return &user
+	}
+
+	for _, i := range config.slowHashUsers {
+		if user := config.Users[i]; matchesSecret(token, "", user.TokenHash) {
+			return &user
+		}
+	}
+
+	return nil
+}
+
+// bearerToken returns the token of the Authorization header, the scheme is case-insensitive and headers
+// without scheme are taken as the token.
+func bearerToken(r *http.Request) string {
+	authorization := strings.TrimSpace(r.Header.Get("Authorization"))
+
+	if scheme, token, ok := strings.Cut(authorization, " "); ok && strings.EqualFold(scheme, "bearer") {
+		return strings.TrimSpace(token)
+	}
+
+	return authorization
+}
+
+// findUserByBasicAuth looks up the user by its username, the password has to match the configured
+// password or, when no password is set, the token of the user. Database tokens use their name as username.
+func findUserByBasicAuth(username, password string) *ConfigUser {
 	var found *ConfigUser
-	for _, user := range config.Users {
-		if subtle.ConstantTimeCompare(token, []byte(user.Token)) == 1 {
+	for _, user := range app.Config().Users {
+		if user.Username == "" || subtle.ConstantTimeCompare([]byte(username), []byte(user.Username)) != 1 {
+			continue
+		}
+
+		if user.Password != "" || user.PasswordHash != "" {
+			if matchesSecret(password, user.Password, user.PasswordHash) {
+				found = &user
+			}
+		} else if matchesSecret(password, user.Token, user.TokenHash) {
 			found = &user
-			break
 		}
+
+		return found
+	}
+
+	if dbToken := findDatabaseToken(password); dbToken != nil && dbToken.Name == username {
+		found = dbToken.User()
 	}
 
 	return found
 }
+
+// findUserByCertificate maps a verified client certificate to a user, explicit credentials take precedence
+// over the certificate.
+func findUserByCertificate(certificate *x509.Certificate) *ConfigUser {
+	for _, user := range app.Config().Users {
+		if user.MatchesCertificate(certificate) {
+			return &user
+		}
+	}
+
+	return nil
+}
+
+// authorizeRequest returns the user of the request when it has the scope, otherwise it writes the error
+// response and returns nil.
+func authorizeRequest(w http.ResponseWriter, r *http.Request, scope string) *ConfigUser {
+	user := validateRequest(r)
+	setRequestUser(r, user)
+
+	if user == nil {
+		unauthorized(w)
+		return nil
+	}
+
+	if !user.HasScope(scope) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil
+	}
+
+	return user
+}
+
+// validateAdminRequest accepts the configured admin token and users with the admin scope.
+func validateAdminRequest(r *http.Request) bool {
+	config := app.Config()
+
+	if matchesSecret(bearerToken(r), config.AdminToken, config.AdminTokenHash) {
+		setRequestIdentity(r, "admin")
+		return true
+	}
+
+	user := validateRequest(r)
+	setRequestUser(r, user)
+
+	return user != nil && user.HasScope(scopeAdmin)
+}
+
+// unauthorized rejects the request with a challenge, so Composer asks for http-basic credentials.
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Composer Registry"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Change log entries are kept for this long, clients polling with an older timestamp have to resync.
+const changeLogRetention = 30 * 24 * time.Hour
+
+type MetadataChange struct {
+	Type    string `json:"type"`
+	Package string `json:"package"`
+	Time    int64  `json:"time"`
+}
+
+// changeTimestamp returns the current time in the 1/10000 second resolution used by Packagist.
+func changeTimestamp(t time.Time) uint64 {
+	return uint64(t.UnixNano() / 100000)
+}
+
+// recordChange appends an entry to the change log for the given package version. The action is
+// "delete" when no versions of the same stability remain, otherwise "update".
+func recordChange(tx *bolt.Tx, packageName, version string) error {
+	bucket := tx.Bucket([]byte("changes"))
+
+	metadataName := packageName
+	keyPrefix := "packages--" + packageName + "|"
+	isDev := strings.HasPrefix(version, "dev-")
+	if isDev {
+		metadataName = packageName + "~dev"
+	}
+
+	changeType := "delete"
+	c := tx.Bucket([]byte("packages")).Cursor()
+	prefix := []byte(keyPrefix)
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if strings.HasPrefix(string(k), keyPrefix+"dev-") == isDev {
+			changeType = "update"
+			break
+		}
+	}
+
+	now := time.Now()
+	timestamp := changeTimestamp(now)
+
+	// keys must be strictly increasing, even when the clock goes backwards or two changes share a tick
+	if last, _ := bucket.Cursor().Last(); last != nil {
+		if lastTimestamp := binary.BigEndian.Uint64(last); lastTimestamp >= timestamp {
+			timestamp = lastTimestamp + 1
+		}
+	}
+
+	data, err := json.Marshal(MetadataChange{Type: changeType, Package: metadataName, Time: now.Unix()})
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, timestamp)
+
+	if err := bucket.Put(key, data); err != nil {
+		return err
+	}
+
+	return pruneChanges(bucket, now)
+}
+
+func pruneChanges(bucket *bolt.Bucket, now time.Time) error {
+	oldest := changeTimestamp(now.Add(-changeLogRetention))
+
+	c := bucket.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < oldest; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func metadataChangesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := authorizeRequest(w, r, scopeRead)
+
+	if user == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	now := time.Now()
+	timestamp := changeTimestamp(now)
+
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":     "Invalid or missing \"since\" query parameter, make sure you store the timestamp at the initial point you started mirroring, then send that to begin receiving changes, e.g. /metadata/changes.json?since=" + strconv.FormatUint(timestamp, 10),
+			"timestamp": timestamp,
+		})
+		return
+	}
+
+	if since < changeTimestamp(now.Add(-changeLogRetention)) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"actions":   []MetadataChange{{Type: "resync", Package: "*", Time: now.Unix()}},
+			"timestamp": timestamp,
+		})
+		return
+	}
+
+	// the returned timestamp is the last change this snapshot has seen, so changes committed
+	// concurrently are never skipped by the next poll
+	actions := make([]MetadataChange, 0)
+	timestamp = since
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("changes")).Cursor()
+
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, since+1)
+
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			var change MetadataChange
+
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+
+			timestamp = binary.BigEndian.Uint64(k)
+
+			if !user.HasAccessToPackage(strings.TrimSuffix(change.Package, "~dev")) {
+				continue
+			}
+
+			actions = append(actions, change)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithContext(r.Context()).Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{"actions": actions, "timestamp": timestamp})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
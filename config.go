@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"net/netip"
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
+	"reflect"
+	"regexp"
+	"time"
 
 	"github.com/caarlos0/env/v11"
 	log "github.com/sirupsen/logrus"
@@ -14,71 +18,255 @@ import (
 )
 
 type ConfigUser struct {
-	Token string           `yaml:"token" json:"token"`
-	Rules []ConfigUserRule `yaml:"rules" json:"rules"`
+	Username     string           `yaml:"username" json:"username"`
+	Password     string           `yaml:"password" json:"password"`
+	PasswordFile string           `yaml:"password_file" json:"password_file"`
+	PasswordHash string           `yaml:"password_hash" json:"password_hash"`
+	Token        string           `yaml:"token" json:"token"`
+	TokenFile    string           `yaml:"token_file" json:"token_file"`
+	TokenHash    string           `yaml:"token_hash" json:"token_hash"`
+	Rules        []ConfigUserRule `yaml:"rules" json:"rules"`
+	Scopes       []string         `yaml:"scopes" json:"scopes"`
+	AllowedIPs   []string         `yaml:"allowed_ips" json:"allowed_ips"`
+
+	// PublishRules limit the packages the user may publish and delete, without them the rules are used
+	PublishRules []ConfigUserRule `yaml:"publish_rules" json:"publish_rules"`
+
+	// ClientCertificates authenticate the user with a verified client certificate, e.g. cn:agent-1
+	ClientCertificates []string `yaml:"client_certificates" json:"client_certificates"`
+
+	anonymous       bool
+	identity        string
+	allowedNetworks []netip.Prefix
 }
 
 type ConfigUserRule struct {
-	Type  string `json:"type"`
-	Value string `json:"value"`
+	Type  string `yaml:"type" json:"type"`
+	Value string `yaml:"value" json:"value"`
+	Deny  bool   `yaml:"deny" json:"deny,omitempty"`
+
+	// Constraint and ReleasedBefore limit the rule to matching versions
+	Constraint     string `yaml:"constraint" json:"constraint,omitempty"`
+	ReleasedBefore string `yaml:"released_before" json:"released_before,omitempty"`
+
+	regex          *regexp.Regexp
+	constraint     *VersionConstraint
+	releasedBefore time.Time
+}
+
+type ConfigOIDC struct {
+	Issuer   string              `yaml:"issuer" json:"issuer"`
+	Audience string              `yaml:"audience" json:"audience"`
+	JWKSFile string              `yaml:"jwks_file" json:"jwks_file"`
+	JWKSURL  string              `yaml:"jwks_url" json:"jwks_url"`
+	Mappings []ConfigOIDCMapping `yaml:"mappings" json:"mappings"`
+}
+
+// ConfigOIDCMapping grants the rules when the claim has the given value, an empty value matches any
+// value. The placeholder {value} in rule values is replaced with the claim value.
+type ConfigOIDCMapping struct {
+	Claim        string           `yaml:"claim" json:"claim"`
+	Value        string           `yaml:"value" json:"value"`
+	Rules        []ConfigUserRule `yaml:"rules" json:"rules"`
+	PublishRules []ConfigUserRule `yaml:"publish_rules" json:"publish_rules"`
+	Scopes       []string         `yaml:"scopes" json:"scopes"`
+}
+
+// ConfigRateLimit limits metadata and download requests, zero disables a limit. The lockout blocks an IP
+// for LockoutDuration seconds after LockoutFailures failed authentications within that duration.
+type ConfigRateLimit struct {
+	RequestsPerMinute   int   `yaml:"requests_per_minute" json:"requests_per_minute"`
+	BytesPerDay         int64 `yaml:"bytes_per_day" json:"bytes_per_day"`
+	IPRequestsPerMinute int   `yaml:"ip_requests_per_minute" json:"ip_requests_per_minute"`
+	IPBytesPerDay       int64 `yaml:"ip_bytes_per_day" json:"ip_bytes_per_day"`
+	LockoutFailures     int   `yaml:"lockout_failures" json:"lockout_failures"`
+	LockoutDuration     int   `yaml:"lockout_duration" json:"lockout_duration"`
+}
+
+// ConfigAudit enables the audit log, which is stored in the database and optionally appended to File as JSON
+// lines. Entries older than RetentionDays are removed from the database, zero keeps them forever.
+type ConfigAudit struct {
+	Enabled       bool   `yaml:"enabled" json:"enabled"`
+	File          string `yaml:"file" json:"file"`
+	RetentionDays int    `yaml:"retention_days" json:"retention_days"`
+}
+
+// ConfigTLS lets the registry terminate TLS itself. With a ClientCAFile, client certificates signed by that
+// CA are verified and can be mapped to users.
+type ConfigTLS struct {
+	CertFile                 string `yaml:"cert_file" json:"cert_file"`
+	KeyFile                  string `yaml:"key_file" json:"key_file"`
+	ClientCAFile             string `yaml:"client_ca_file" json:"client_ca_file"`
+	RequireClientCertificate bool   `yaml:"require_client_certificate" json:"require_client_certificate"`
+}
+
+// ConfigMetrics enables the Prometheus metrics on /metrics, served on BindAddress when set and otherwise on
+// the main address. With a token, scrapes have to send it as bearer token.
+type ConfigMetrics struct {
+	Enabled     bool   `yaml:"enabled" json:"enabled"`
+	BindAddress string `yaml:"bind_address" json:"bind_address"`
+	Token       string `yaml:"token" json:"token"`
+	TokenFile   string `yaml:"token_file" json:"token_file"`
+	TokenHash   string `yaml:"token_hash" json:"token_hash"`
+}
+
+// ConfigTracing exports OpenTelemetry spans with the otlp exporter over HTTP or prints them with the stdout
+// exporter. Without an endpoint, the OTEL_EXPORTER_OTLP_* environment variables are used.
+type ConfigTracing struct {
+	Exporter    string   `yaml:"exporter" json:"exporter"`
+	Endpoint    string   `yaml:"endpoint" json:"endpoint"`
+	ServiceName string   `yaml:"service_name" json:"service_name"`
+	SampleRatio *float64 `yaml:"sample_ratio" json:"sample_ratio"`
+}
+
+// ConfigLog sets the level and the text or json format of the log. AccessLog writes an access log of the
+// requests in json or the combined format to stdout, or to AccessLogFile when set.
+type ConfigLog struct {
+	Level         string `yaml:"level" json:"level" env:"COMPOSER_REGISTRY_LOG_LEVEL"`
+	Format        string `yaml:"format" json:"format" env:"COMPOSER_REGISTRY_LOG_FORMAT"`
+	AccessLog     string `yaml:"access_log" json:"access_log"`
+	AccessLogFile string `yaml:"access_log_file" json:"access_log_file"`
 }
 
 type Config struct {
-	Providers   []ConfigProvider `yaml:"providers" json:"providers"`
-	Users       []ConfigUser     `yaml:"users" json:"users"`
-	URL         string           `yaml:"base_url" json:"base_url" env:"COMPOSER_REGISTRY_URL"`
-	StoragePath string           `yaml:"storage_path" json:"storage_path" env:"COMPOSER_REGISTRY_STORAGE_PATH"`
-	BindAddress string           `yaml:"bind_address" json:"bind_address" env:"COMPOSER_REGISTRY_BIND_ADDRESS"`
+	Providers       []ConfigProvider `yaml:"providers" json:"providers"`
+	Users           []ConfigUser     `yaml:"users" json:"users"`
+	OIDC            []ConfigOIDC     `yaml:"oidc" json:"oidc"`
+	RateLimit       ConfigRateLimit  `yaml:"rate_limit" json:"rate_limit"`
+	Audit           ConfigAudit      `yaml:"audit" json:"audit"`
+	TLS             ConfigTLS        `yaml:"tls" json:"tls"`
+	Metrics         ConfigMetrics    `yaml:"metrics" json:"metrics"`
+	Tracing         ConfigTracing    `yaml:"tracing" json:"tracing"`
+	Log             ConfigLog        `yaml:"log" json:"log"`
+	URL             string           `yaml:"base_url" json:"base_url" env:"COMPOSER_REGISTRY_URL"`
+	StoragePath     string           `yaml:"storage_path" json:"storage_path" env:"COMPOSER_REGISTRY_STORAGE_PATH"`
+	BindAddress     string           `yaml:"bind_address" json:"bind_address" env:"COMPOSER_REGISTRY_BIND_ADDRESS"`
+	AdminToken      string           `yaml:"admin_token" json:"admin_token" env:"COMPOSER_REGISTRY_ADMIN_TOKEN"`
+	AdminTokenFile  string           `yaml:"admin_token_file" json:"admin_token_file" env:"COMPOSER_REGISTRY_ADMIN_TOKEN_FILE"`
+	AdminTokenHash  string           `yaml:"admin_token_hash" json:"admin_token_hash"`
+	TrustedProxies  []string         `yaml:"trusted_proxies" json:"trusted_proxies"`
+	ShutdownTimeout int              `yaml:"shutdown_timeout" json:"shutdown_timeout" env:"COMPOSER_REGISTRY_SHUTDOWN_TIMEOUT"`
+	WatchConfig     bool             `yaml:"watch_config" json:"watch_config"`
+
+	trustedProxies []netip.Prefix
+	userTokens     map[[sha256.Size]byte]int
+	slowHashUsers  []int
 }
 type ConfigProjects struct {
 	Name string `yaml:"name"`
 }
 type ConfigProvider struct {
-	Name            string           `yaml:"name" json:"name"`
-	Type            string           `yaml:"type" json:"type"`
-	Domain          string           `yaml:"domain" json:"domain"`
-	Token           string           `yaml:"token" json:"token"`
-	WebhookSecret   string           `yaml:"webhook_secret" json:"webhook_secret"`
-	Projects        []ConfigProjects `yaml:"projects" json:"projects"`
-	FetchAllOnStart bool             `yaml:"fetch_all_on_start" json:"fetch_all_on_start"`
-	CronSchedule    string           `yaml:"cron_schedule" json:"cron_schedule"`
+	Name              string           `yaml:"name" json:"name"`
+	Type              string           `yaml:"type" json:"type"`
+	Domain            string           `yaml:"domain" json:"domain"`
+	Token             string           `yaml:"token" json:"token"`
+	TokenFile         string           `yaml:"token_file" json:"token_file"`
+	WebhookSecret     string           `yaml:"webhook_secret" json:"webhook_secret"`
+	WebhookSecretFile string           `yaml:"webhook_secret_file" json:"webhook_secret_file"`
+	WebhookSecretHash string           `yaml:"webhook_secret_hash" json:"webhook_secret_hash"`
+	Projects          []ConfigProjects `yaml:"projects" json:"projects"`
+	FetchAllOnStart   bool             `yaml:"fetch_all_on_start" json:"fetch_all_on_start"`
+	CronSchedule      string           `yaml:"cron_schedule" json:"cron_schedule"`
+	AllowedIPs        []string         `yaml:"allowed_ips" json:"allowed_ips"`
+	AllowedIPsFile    string           `yaml:"allowed_ips_file" json:"allowed_ips_file"`
+
+	// AllowSecretPublish lets the webhook_secret of a custom provider publish and delete every package, it
+	// is deprecated in favor of users with the publish and delete scopes
+	AllowSecretPublish bool `yaml:"allow_secret_publish" json:"allow_secret_publish"`
+
+	allowedNetworks []netip.Prefix
 }
 
+// LoadConfig reads and validates the config file. Warnings are logged, errors are returned as ConfigProblems.
 func LoadConfig() (*Config, error) {
+	config, problems, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, problem := range problems {
+		if problem.Warning {
+			log.WithField("path", problem.Path).Warn("config: " + problem.Message)
+		}
+	}
+
+	if errors := problems.errors(); len(errors) > 0 {
+		return nil, errors
+	}
+
+	if _, err := os.Stat(config.StoragePath); os.IsNotExist(err) {
+		if err := os.MkdirAll(config.StoragePath, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+
+	log.WithField("storage_path", config.StoragePath).Info("config: using storage")
+
+	return config, nil
+}
+
+// readConfig decodes the config file and validates it without changing anything on disk, so it can also be
+// used to check a config. Defaults are applied after the validation.
+func readConfig() (*Config, ConfigProblems, error) {
 	var config Config
+	var properties interface{}
 
 	if _, err := os.Stat(configFile); err != nil {
-		return nil, fmt.Errorf("cannot find config file at %s", configFile)
+		return nil, nil, fmt.Errorf("cannot find config file at %s", configFile)
 	}
 
 	bytes, err := os.ReadFile(configFile)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	configExtension := filepath.Ext(configFile)
-	if configExtension == ".yml" || configExtension == ".yaml" {
-		err = yaml.Unmarshal(bytes, &config)
 
-		if err != nil {
-			return nil, err
-		}
-	} else if configExtension == ".json" {
-		err = json.Unmarshal(bytes, &config)
+	// the file is decoded before the environment variables are replaced, so they are never parsed as yaml or
+	// json
+	var marshal func(interface{}) ([]byte, error)
+	var unmarshal func([]byte, interface{}) error
 
-		if err != nil {
-			return nil, err
-		}
+	if configExtension == ".yml" || configExtension == ".yaml" {
+		marshal, unmarshal = yaml.Marshal, yaml.Unmarshal
+	} else if configExtension == ".json" {
+		marshal, unmarshal = json.Marshal, json.Unmarshal
 	} else {
-		return nil, fmt.Errorf("config file is not a json or yaml file")
+		return nil, nil, fmt.Errorf("config file is not a json or yaml file")
+	}
+
+	if err := unmarshal(bytes, &properties); err != nil {
+		return nil, nil, err
+	}
+
+	var problems ConfigProblems
+	properties = interpolateEnv(properties, reflect.TypeOf(config), "", &problems)
+
+	if bytes, err = marshal(properties); err != nil {
+		return nil, nil, err
+	}
+
+	if err := unmarshal(bytes, &config); err != nil {
+		return nil, nil, err
 	}
 
+	// env fails on pointers to other types than structs, the sample ratio has no env variable anyway
+	sampleRatio := config.Tracing.SampleRatio
+	config.Tracing.SampleRatio = nil
+
 	err = env.Parse(&config)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	config.Tracing.SampleRatio = sampleRatio
+
+	problems = append(problems, unknownProperties(properties, reflect.TypeOf(config), "")...)
+	problems = append(problems, readSecrets(&config)...)
+	problems = append(problems, validateConfig(&config)...)
+	indexUserTokens(&config)
+
 	if config.StoragePath == "" {
 		cwd, err := os.Getwd()
 
@@ -89,55 +277,17 @@ func LoadConfig() (*Config, error) {
 		}
 	}
 
-	if config.BindAddress == "" {
-		config.BindAddress = "127.0.0.1:8080"
+	if config.RateLimit.LockoutFailures > 0 && config.RateLimit.LockoutDuration <= 0 {
+		config.RateLimit.LockoutDuration = 300
 	}
 
-	if _, err := os.Stat(config.StoragePath); os.IsNotExist(err) {
-		if err := os.MkdirAll(config.StoragePath, os.ModePerm); err != nil {
-			return nil, err
-		}
+	if config.BindAddress == "" {
+		config.BindAddress = "127.0.0.1:8080"
 	}
 
-	log.Infof("config: using %s as storage", config.StoragePath)
-
 	if config.URL == "" {
 		config.URL = "http://localhost:8080"
-		log.Infof("config: base_url is not set in config. defaulting to http://localhost:8080")
-	}
-
-	return &config, nil
-}
-
-func getZipPath(name string, version string) string {
-	return path.Join(config.StoragePath, "packages", name, version+".zip")
-}
-
-func (c ConfigUser) HasAccessToPackage(packageName string) bool {
-	if len(c.Rules) == 0 {
-		return true
-	}
-
-	for _, rule := range c.Rules {
-		switch rule.Type {
-		case "begins_with":
-			if strings.HasPrefix(packageName, rule.Value) {
-				return true
-			}
-		case "ends_with":
-			if strings.HasSuffix(packageName, rule.Value) {
-				return true
-			}
-		case "contains":
-			if strings.Contains(packageName, rule.Value) {
-				return true
-			}
-		case "equals":
-			if packageName == rule.Value {
-				return true
-			}
-		}
 	}
 
-	return false
+	return &config, problems, nil
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLoadConfigSampleRatio(t *testing.T) {
+	dir := t.TempDir()
+	previousConfigFile := configFile
+	t.Cleanup(func() { configFile = previousConfigFile })
+
+	config := loadTestConfig(t, dir, "config.json", fmt.Sprintf(`{
+		"base_url": "http://localhost",
+		"storage_path": %q,
+		"tracing": {"sample_ratio": 0}
+	}`, dir))
+
+	if config.Tracing.SampleRatio == nil || *config.Tracing.SampleRatio != 0 {
+		t.Errorf("expected the sample ratio 0, got %v", config.Tracing.SampleRatio)
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	dir := t.TempDir()
+	previousApp, previousConfigFile := app, configFile
+	t.Cleanup(func() { app, configFile = previousApp, previousConfigFile })
+
+	app = &App{}
+
+	// sha256 of "secret"
+	config := loadTestConfig(t, dir, "config.json", fmt.Sprintf(`{
+		"base_url": "http://localhost",
+		"storage_path": %q,
+		"users": [{"username": "ci", "password_hash": "sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}]
+	}`, dir))
+
+	if _, err := app.apply(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if findUserByBasicAuth("ci", "secret") == nil {
+		t.Error("expected the password to match the password_hash")
+	}
+
+	if findUserByBasicAuth("ci", "wrong") != nil {
+		t.Error("expected a wrong password to be rejected")
+	}
+}
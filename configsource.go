@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envPlaceholderPattern matches ${NAME} and ${NAME:-default}, $${ is an escaped ${
+var envPlaceholderPattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// envValuePattern matches a value which is a single placeholder, it may be converted to a number or boolean
+var envValuePattern = regexp.MustCompile(`^\$\{[A-Za-z_][A-Za-z0-9_]*(?::-[^}]*)?\}$`)
+
+// interpolateEnv replaces ${NAME} placeholders in the string values of the decoded config file with
+// environment variables. Keys and other values are not changed, so a variable cannot change the structure of
+// the file, whatever it contains. A value which is a single placeholder is converted to the kind of its
+// option typ, e.g. shutdown_timeout: ${TIMEOUT}. path is the path of value, e.g. providers[0].webhook_secret.
+func interpolateEnv(value interface{}, typ reflect.Type, path string, problems *ConfigProblems) interface{} {
+	for typ != nil && typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	switch value := value.(type) {
+	case string:
+		unset := len(*problems)
+		expanded := expandEnv(value, path, problems)
+		if typ == nil || !envValuePattern.MatchString(value) {
+			return expanded
+		}
+
+		// the option stays empty, so the file still decodes and all problems are reported
+		if len(*problems) > unset {
+			return nil
+		}
+
+		return convertEnvValue(expanded, typ.Kind(), path, problems)
+	case map[string]interface{}:
+		var fields map[string]reflect.Type
+		if typ != nil && typ.Kind() == reflect.Struct {
+			fields = configFields(typ)
+		}
+
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			propertyPath := name
+			if path != "" {
+				propertyPath = path + "." + name
+			}
+
+			value[name] = interpolateEnv(value[name], fields[name], propertyPath, problems)
+		}
+	case []interface{}:
+		var itemType reflect.Type
+		if typ != nil && typ.Kind() == reflect.Slice {
+			itemType = typ.Elem()
+		}
+
+		for i, item := range value {
+			value[i] = interpolateEnv(item, itemType, fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	}
+
+	return value
+}
+
+// convertEnvValue converts the value of a placeholder to the number or boolean the option expects, other
+// options keep the string. Values which cannot be converted are reported and left empty.
+func convertEnvValue(value string, kind reflect.Kind, path string, problems *ConfigProblems) interface{} {
+	switch kind {
+	case reflect.Bool:
+		converted, err := strconv.ParseBool(value)
+		if err != nil {
+			problems.add(path, "%q is not a boolean", value)
+			return nil
+		}
+
+		return converted
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		converted, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			problems.add(path, "%q is not an integer", value)
+			return nil
+		}
+
+		return converted
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		converted, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			problems.add(path, "%q is not a positive integer", value)
+			return nil
+		}
+
+		return converted
+	case reflect.Float32, reflect.Float64:
+		converted, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			problems.add(path, "%q is not a number", value)
+			return nil
+		}
+
+		return converted
+	}
+
+	return value
+}
+
+// expandEnv replaces the placeholders of a single value, a variable without default that is not set is
+// reported with the path of the value.
+func expandEnv(value string, path string, problems *ConfigProblems) string {
+	return envPlaceholderPattern.ReplaceAllStringFunc(value, func(placeholder string) string {
+		if placeholder == "$${" {
+			return "${"
+		}
+
+		match := envPlaceholderPattern.FindStringSubmatch(placeholder)
+
+		if value, ok := os.LookupEnv(match[1]); ok {
+			return value
+		}
+
+		if strings.Contains(placeholder, ":-") {
+			return match[2]
+		}
+
+		problems.add(path, "environment variable %s is not set", match[1])
+
+		return placeholder
+	})
+}
+
+// readSecrets reads the *_file options, e.g. Docker or Kubernetes secrets, and applies the provider env
+// overrides COMPOSER_REGISTRY_PROVIDER_<NAME>_TOKEN and _WEBHOOK_SECRET, which take precedence.
+func readSecrets(config *Config) ConfigProblems {
+	var problems ConfigProblems
+
+	readSecret := func(path string, value *string, file string) {
+		if file == "" {
+			return
+		}
+
+		if *value != "" {
+			problems.add(path+"_file", "cannot be used together with %s", path[strings.LastIndex(path, ".")+1:])
+			return
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			problems.add(path+"_file", "%s", err)
+			return
+		}
+
+		*value = strings.TrimRight(string(data), "\r\n")
+	}
+
+	readSecret("admin_token", &config.AdminToken, config.AdminTokenFile)
+	readSecret("metrics.token", &config.Metrics.Token, config.Metrics.TokenFile)
+
+	for i := range config.Users {
+		user := &config.Users[i]
+
+		readSecret(fmt.Sprintf("users[%d].token", i), &user.Token, user.TokenFile)
+		readSecret(fmt.Sprintf("users[%d].password", i), &user.Password, user.PasswordFile)
+	}
+
+	for i := range config.Providers {
+		provider := &config.Providers[i]
+
+		readSecret(fmt.Sprintf("providers[%d].token", i), &provider.Token, provider.TokenFile)
+		readSecret(fmt.Sprintf("providers[%d].webhook_secret", i), &provider.WebhookSecret, provider.WebhookSecretFile)
+
+		prefix := providerEnvPrefix(provider.Name)
+
+		if value, ok := os.LookupEnv(prefix + "TOKEN"); ok {
+			provider.Token = value
+		}
+
+		if value, ok := os.LookupEnv(prefix + "WEBHOOK_SECRET"); ok {
+			provider.WebhookSecret = value
+		}
+	}
+
+	return problems
+}
+
+// providerEnvPrefix returns the prefix of the env overrides of a provider, the name is upper cased and other
+// characters than letters and digits are replaced with _, e.g. COMPOSER_REGISTRY_PROVIDER_MY_GITLAB_
+func providerEnvPrefix(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return '_'
+	}, strings.ToUpper(name))
+
+	return "COMPOSER_REGISTRY_PROVIDER_" + name + "_"
+}
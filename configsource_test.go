@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("REGISTRY_TOKEN", "a\"b\nadmin_token: injected")
+
+	value := map[string]interface{}{
+		"${REGISTRY_TOKEN}": "key",
+		"base_url":          "${REGISTRY_URL:-http://localhost}/",
+		"shutdown_timeout":  float64(30),
+		"users": []interface{}{
+			map[string]interface{}{"token": "${REGISTRY_TOKEN}", "username": "$${REGISTRY_TOKEN}"},
+			map[string]interface{}{"token": "${REGISTRY_UNSET}"},
+		},
+	}
+
+	want := map[string]interface{}{
+		"${REGISTRY_TOKEN}": "key",
+		"base_url":          "http://localhost/",
+		"shutdown_timeout":  float64(30),
+		"users": []interface{}{
+			map[string]interface{}{"token": "a\"b\nadmin_token: injected", "username": "${REGISTRY_TOKEN}"},
+			map[string]interface{}{"token": nil},
+		},
+	}
+
+	var problems ConfigProblems
+	got := interpolateEnv(value, reflect.TypeOf(Config{}), "", &problems)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("interpolateEnv() = %v, want %v", got, want)
+	}
+
+	wantProblems := ConfigProblems{{Path: "users[1].token", Message: "environment variable REGISTRY_UNSET is not set"}}
+	if !reflect.DeepEqual(problems, wantProblems) {
+		t.Errorf("problems = %v, want %v", problems, wantProblems)
+	}
+}
+
+func TestInterpolateEnvConvertsSinglePlaceholders(t *testing.T) {
+	t.Setenv("REGISTRY_TIMEOUT", "30")
+	t.Setenv("REGISTRY_METRICS", "true")
+	t.Setenv("REGISTRY_RATIO", "0.5")
+	t.Setenv("REGISTRY_TOKEN", "123")
+
+	value := map[string]interface{}{
+		"shutdown_timeout": "${REGISTRY_TIMEOUT}",
+		"metrics":          map[string]interface{}{"enabled": "${REGISTRY_METRICS}"},
+		"tracing":          map[string]interface{}{"sample_ratio": "${REGISTRY_RATIO}"},
+		"rate_limit":       map[string]interface{}{"requests_per_minute": "${REGISTRY_UNSET_LIMIT:-60}", "bytes_per_day": "${REGISTRY_METRICS}"},
+		"users":            []interface{}{map[string]interface{}{"token": "${REGISTRY_TOKEN}", "username": "ci-${REGISTRY_TOKEN}"}},
+	}
+
+	want := map[string]interface{}{
+		"shutdown_timeout": int64(30),
+		"metrics":          map[string]interface{}{"enabled": true},
+		"tracing":          map[string]interface{}{"sample_ratio": 0.5},
+		"rate_limit":       map[string]interface{}{"requests_per_minute": int64(60), "bytes_per_day": nil},
+		"users":            []interface{}{map[string]interface{}{"token": "123", "username": "ci-123"}},
+	}
+
+	var problems ConfigProblems
+	got := interpolateEnv(value, reflect.TypeOf(Config{}), "", &problems)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("interpolateEnv() = %v, want %v", got, want)
+	}
+
+	wantProblems := ConfigProblems{{Path: "rate_limit.bytes_per_day", Message: `"true" is not an integer`}}
+	if !reflect.DeepEqual(problems, wantProblems) {
+		t.Errorf("problems = %v, want %v", problems, wantProblems)
+	}
+}
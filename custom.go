@@ -3,6 +3,7 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type CustomProvider struct {
@@ -27,7 +29,7 @@ func (c CustomProvider) GetConfig() ConfigProvider {
 	return c.provider
 }
 
-func (c CustomProvider) UpdateAll() error {
+func (c CustomProvider) UpdateAll(ctx context.Context) error {
 	return nil
 }
 
@@ -35,14 +37,31 @@ func (c CustomProvider) Webhook(r *http.Request) error {
 	return nil
 }
 
-func (c CustomProvider) RegisterCustomHTTPHandlers(router *httprouter.Router) {
-	router.POST("/custom/package/create", c.CreateVersion)
-	router.DELETE("/custom/package/:owner/:repo/:version", c.DeleteVersion)
+// registerCustomProviderHandlers registers the package API of the custom provider. The routes are registered
+// once, the requests are handled by the first custom provider of the current config.
+func registerCustomProviderHandlers(router *Router) {
+	router.POST("/custom/package/create", audited("publish", throttledAuth(withCustomProvider(CustomProvider.CreateVersion))))
+	router.DELETE("/custom/package/:owner/:repo/:version", audited("delete", throttledAuth(withCustomProvider(CustomProvider.DeleteVersion))))
+}
+
+func withCustomProvider(handle func(CustomProvider, http.ResponseWriter, *http.Request, httprouter.Params)) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		state := app.current()
+
+		for _, provider := range state.config.Providers {
+			if custom, ok := state.providers[provider.Name].(CustomProvider); ok {
+				handle(custom, w, r, ps)
+				return
+			}
+		}
+
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
 }
 
 func (c CustomProvider) CreateVersion(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	if !c.auth(r) {
-		w.WriteHeader(http.StatusUnauthorized)
+	user := c.authorize(w, r, scopePublish)
+	if user == nil {
 		return
 	}
 
@@ -112,10 +131,36 @@ func (c CustomProvider) CreateVersion(w http.ResponseWriter, r *http.Request, ps
 		return
 	}
 
-	link := fmt.Sprintf("%s/custom/%s/%s/file.zip", config.URL, packageName, packageVersion)
+	auditPackage(r, packageName, packageVersion)
+
+	if !user.CanChangePackage(packageName) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Not allowed to publish this package."))
+		return
+	}
+
+	zipPath, err := getZipPath(packageName, packageVersion)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	link := fmt.Sprintf("%s/custom/%s/%s/file.zip", app.Config().URL, packageName, packageVersion)
+
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		// an upload is the release, uploading the version again keeps its first release date
+		infoKey := "custom-" + packageName + "-" + packageVersion
+		released := storedReleaseTime(tx, infoKey, link)
+		if released.IsZero() {
+			released = time.Now()
+		}
+
+		if err := addOrUpdateVersionDirect(tx, composerJson, link, packageVersion, infoKey, c.provider.Name, released); err != nil {
+			return err
+		}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		return addOrUpdateVersionDirect(tx, composerJson, link, packageVersion, "custom-"+packageName+"-"+packageVersion)
+		return setDistPath(tx, packageName, packageVersion, zipPath)
 	})
 
 	if err != nil {
@@ -124,7 +169,6 @@ func (c CustomProvider) CreateVersion(w http.ResponseWriter, r *http.Request, ps
 		return
 	}
 
-	zipPath := getZipPath(packageName, packageVersion)
 	zipFolder := filepath.Dir(zipPath)
 
 	if _, err := os.Stat(zipFolder); os.IsNotExist(err) {
@@ -145,8 +189,8 @@ func (c CustomProvider) CreateVersion(w http.ResponseWriter, r *http.Request, ps
 }
 
 func (c CustomProvider) DeleteVersion(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	if !c.auth(r) {
-		w.WriteHeader(http.StatusUnauthorized)
+	user := c.authorize(w, r, scopeDelete)
+	if user == nil {
 		return
 	}
 
@@ -154,11 +198,30 @@ func (c CustomProvider) DeleteVersion(w http.ResponseWriter, r *http.Request, ps
 	repo := ps.ByName("repo")
 	version := ps.ByName("version")
 
+	if !user.CanChangePackage(owner + "/" + repo) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Not allowed to delete this package."))
+		return
+	}
+
 	key := fmt.Sprintf("custom-%s/%s-%s", owner, repo, version)
 
-	log.Infof(key)
+	log.WithContext(r.Context()).WithFields(log.Fields{"provider": c.provider.Name, "package": owner + "/" + repo, "version": version}).Info("deleting version")
+
+	if err := validatePackagePath(owner+"/"+repo, version); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var zipPath string
+
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if zipPath, err = getDistPath(tx, owner+"/"+repo, version); err != nil {
+			return err
+		}
 
-	err := db.Update(func(tx *bolt.Tx) error {
 		return deleteVersion(tx, key)
 	})
 
@@ -168,7 +231,11 @@ func (c CustomProvider) DeleteVersion(w http.ResponseWriter, r *http.Request, ps
 		return
 	}
 
-	zipPath := getZipPath(owner+"/"+repo, version)
+	if zipPath == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
 	if err := os.Remove(zipPath); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
@@ -178,12 +245,37 @@ func (c CustomProvider) DeleteVersion(w http.ResponseWriter, r *http.Request, ps
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (c CustomProvider) auth(r *http.Request) bool {
-	if c.provider.WebhookSecret == "" {
-		return true
+// authorize accepts a user with the scope, or the webhook secret from the allowed_ips of the provider with
+// allow_secret_publish. Otherwise it writes 401 for missing or invalid credentials and 403 for users without
+// the scope, and returns nil. Without a secret and without configured users, the API is open like before.
+func (c CustomProvider) authorize(w http.ResponseWriter, r *http.Request, scope string) *ConfigUser {
+	hasSecret := c.provider.WebhookSecret != "" || c.provider.WebhookSecretHash != ""
+
+	if hasSecret && c.provider.AllowSecretPublish {
+		scheme, secret, ok := strings.Cut(r.Header.Get("authorization"), " ")
+		if ok && strings.EqualFold(scheme, "bearer") && matchesSecret(secret, c.provider.WebhookSecret, c.provider.WebhookSecretHash) {
+			if !c.provider.AllowsIP(clientIP(r)) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return nil
+			}
+
+			setRequestIdentity(r, "provider:"+c.provider.Name)
+			return &ConfigUser{Rules: make([]ConfigUserRule, 0), Scopes: []string{scope}}
+		}
 	}
 
-	authHeader := strings.ToLower(r.Header.Get("authorization"))
+	user := validateRequest(r)
+	setRequestUser(r, user)
+	if user == nil || (user.anonymous && hasSecret) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+
+	if !user.HasScope(scope) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Missing the " + scope + " scope."))
+		return nil
+	}
 
-	return strings.TrimPrefix(authHeader, "bearer ") == c.provider.WebhookSecret
+	return user
 }
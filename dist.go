@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	packageNamePattern = regexp.MustCompile(`(?i)^[a-z0-9]([_.-]?[a-z0-9]+)*/[a-z0-9](([_.]|-{1,2})?[a-z0-9]+)*$`)
+	versionPathPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+)
+
+// validatePackagePath rejects package names and versions which cannot safely be used as path components.
+func validatePackagePath(name, version string) error {
+	if !packageNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid package name %q", name)
+	}
+
+	if !versionPathPattern.MatchString(version) {
+		return fmt.Errorf("invalid package version %q", version)
+	}
+
+	return nil
+}
+
+func getZipPath(name string, version string) (string, error) {
+	if err := validatePackagePath(name, version); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(app.Config().StoragePath, "packages", name, version+".zip"), nil
+}
+
+// setDistPath remembers where the zip of a version is stored, downloads are only served for stored paths.
+func setDistPath(tx *bolt.Tx, name, version, zipPath string) error {
+	relativePath, err := filepath.Rel(app.Config().StoragePath, zipPath)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte("packages")).Put([]byte("dist--"+name+"|"+version), []byte(filepath.ToSlash(relativePath)))
+}
+
+// getDistPath returns the zip of a stored version or an empty string when there is none. Versions stored
+// before dist paths were recorded fall back to the default location.
+func getDistPath(tx *bolt.Tx, name, version string) (string, error) {
+	bucket := tx.Bucket([]byte("packages"))
+
+	if bucket.Get([]byte("packages--"+name+"|"+version)) == nil {
+		return "", nil
+	}
+
+	var zipPath string
+
+	if relativePath := bucket.Get([]byte("dist--" + name + "|" + version)); relativePath != nil {
+		zipPath = filepath.Join(app.Config().StoragePath, filepath.FromSlash(string(relativePath)))
+	} else {
+		var err error
+		if zipPath, err = getZipPath(name, version); err != nil {
+			return "", err
+		}
+
+		if _, err := os.Stat(zipPath); err != nil {
+			return "", nil
+		}
+	}
+
+	packagesPath := filepath.Join(app.Config().StoragePath, "packages")
+	if relativePath, err := filepath.Rel(packagesPath, zipPath); err != nil || relativePath == "." || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("dist path of %s %s is outside of the storage", name, version)
+	}
+
+	return zipPath, nil
+}
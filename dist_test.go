@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestValidatePackagePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		valid   bool
+	}{
+		{"acme/tool", "1.0.0", true},
+		{"acme/tool", "v1.0.0-beta.1", true},
+		{"acme/tool", "1.0.0+build.5", true},
+		{"acme/tool", "dev-main", true},
+		{"acme/my--tool", "1.0.0", true},
+		{"../etc", "1.0.0", false},
+		{"acme/..", "1.0.0", false},
+		{"acme/../tool", "1.0.0", false},
+		{"acme/tool/extra", "1.0.0", false},
+		{"acme%2ftool", "1.0.0", false},
+		{"acme\\tool", "1.0.0", false},
+		{"/tool", "1.0.0", false},
+		{"acme/", "1.0.0", false},
+		{"", "1.0.0", false},
+		{"acme/tool", "", false},
+		{"acme/tool", ".", false},
+		{"acme/tool", "..", false},
+		{"acme/tool", "../1.0.0", false},
+		{"acme/tool", "1.0.0/../../config", false},
+		{"acme/tool", "..%2f..%2fconfig", false},
+		{"acme/tool", "1.0.0%2F..", false},
+		{"acme/tool", "1.0.0\\..", false},
+		{"acme/tool", ".hidden", false},
+		{"acme/tool", "1.0.0\x00", false},
+	}
+
+	for _, test := range tests {
+		err := validatePackagePath(test.name, test.version)
+		if test.valid && err != nil {
+			t.Errorf("validatePackagePath(%q, %q) = %v, want no error", test.name, test.version, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("validatePackagePath(%q, %q) accepted an unsafe path", test.name, test.version)
+		}
+	}
+}
+
+func TestGetDistPath(t *testing.T) {
+	dir := t.TempDir()
+	previousApp := app
+	t.Cleanup(func() { app = previousApp })
+
+	app = &App{}
+	app.state.Store(&appState{config: &Config{StoragePath: dir}})
+
+	db, err := bolt.Open(filepath.Join(dir, "packages.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	for _, file := range []string{"packages/acme/tool/1.0.0.zip", "packages/acme/tool/legacy.zip", "packages/acme/tool/unlisted.zip", "config.json"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, file), []byte("zip"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored := map[string]string{
+		"1.0.0":     "packages/acme/tool/1.0.0.zip",
+		"legacy":    "",
+		"missing":   "",
+		"parent":    "../outside.zip",
+		"storage":   "config.json",
+		"traversal": "packages/../config.json",
+		"root":      "packages",
+		"absolute":  "/etc/passwd",
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("packages"))
+		if err != nil {
+			return err
+		}
+
+		for version, distPath := range stored {
+			if err := bucket.Put([]byte("packages--acme/tool|"+version), []byte("{}")); err != nil {
+				return err
+			}
+
+			if distPath == "" {
+				continue
+			}
+
+			if err := bucket.Put([]byte("dist--acme/tool|"+version), []byte(distPath)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		version string
+		want    string
+		wantErr bool
+	}{
+		{"1.0.0", filepath.Join(dir, "packages/acme/tool/1.0.0.zip"), false},
+		{"legacy", filepath.Join(dir, "packages/acme/tool/legacy.zip"), false},
+		{"missing", "", false},
+		{"unlisted", "", false},
+		{"parent", "", true},
+		{"storage", "", true},
+		{"traversal", "", true},
+		{"root", "", true},
+		{"absolute", "", true},
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, test := range tests {
+			got, err := getDistPath(tx, "acme/tool", test.version)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("getDistPath(%q) = %q, want an error", test.version, got)
+				}
+
+				continue
+			}
+
+			if err != nil || got != test.want {
+				t.Errorf("getDistPath(%q) = %q, %v, want %q", test.version, got, err, test.want)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
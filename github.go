@@ -2,12 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/google/go-github/v62/github"
-	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
 	"golang.org/x/oauth2"
@@ -25,24 +25,34 @@ func NewGithubProvider(provider ConfigProvider) GithubProvider {
 	)
 	tc := oauth2.NewClient(ctx, ts)
 
-	return GithubProvider{provider: provider, client: github.NewClient(tc)}
+	return GithubProvider{provider: provider, client: github.NewClient(tracedHTTPClient(tc))}
 }
 
 func (g GithubProvider) GetConfig() ConfigProvider {
 	return g.provider
 }
 
-func (g GithubProvider) UpdateAll() error {
+func (g GithubProvider) UpdateAll(ctx context.Context) error {
 	for _, project := range g.provider.Projects {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		nameSplit := strings.Split(project.Name, "/")
 
-		if err := g.updateAllTags(context.Background(), nameSplit[0], nameSplit[1]); err != nil {
-			log.Errorf("cannot update all tags %s", err.Error())
-		}
+		observeSync(ctx, g.provider.Name, project.Name, func(ctx context.Context) error {
+			tagsErr := g.updateAllTags(ctx, nameSplit[0], nameSplit[1])
+			if tagsErr != nil {
+				log.WithContext(ctx).WithFields(log.Fields{"provider": g.provider.Name, "project": project.Name}).WithError(tagsErr).Error("cannot update all tags")
+			}
 
-		if err := g.updateAllBranches(context.Background(), nameSplit[0], nameSplit[1]); err != nil {
-			log.Errorf("cannot update all tags %s", err.Error())
-		}
+			branchesErr := g.updateAllBranches(ctx, nameSplit[0], nameSplit[1])
+			if branchesErr != nil {
+				log.WithContext(ctx).WithFields(log.Fields{"provider": g.provider.Name, "project": project.Name}).WithError(branchesErr).Error("cannot update all branches")
+			}
+
+			return errors.Join(tagsErr, branchesErr)
+		})
 	}
 
 	return nil
@@ -51,7 +61,9 @@ func (g GithubProvider) UpdateAll() error {
 func (g GithubProvider) Webhook(request *http.Request) error {
 	payload, err := github.ValidatePayload(request, []byte(g.provider.WebhookSecret))
 
-	if err != nil {
+	if err != nil && g.provider.WebhookSecret != "" {
+		return fmt.Errorf("%w: %s", errWebhookSecret, err)
+	} else if err != nil {
 		return err
 	}
 
@@ -76,24 +88,30 @@ func (g GithubProvider) Webhook(request *http.Request) error {
 
 		saveTag := g.generateSaveTag(event.GetRepo().GetOwner().GetName(), event.GetRepo().GetName(), trimmedVersion)
 
-		return db.Update(func(tx *bolt.Tx) error {
-			if event.GetDeleted() {
-				return deleteVersion(tx, saveTag)
-			}
+		// the request is already answered when the push is queued during a sync, ctx is the one of the sync then
+		return app.applyWebhook(request.Context(), g.provider.Name, func(ctx context.Context) error {
+			return tracedUpdate(ctx, "github webhook", func(tx *bolt.Tx) error {
+				if event.GetDeleted() {
+					auditStoredVersion(ctx, tx, saveTag)
+					return deleteVersion(tx, saveTag)
+				}
 
-			return g.addOrUpdate(context.Background(), tx, event.GetRepo().GetOwner().GetName(), event.GetRepo().GetName(), version, event.GetAfter(), saveTag)
+				if err := g.addOrUpdate(ctx, tx, event.GetRepo().GetOwner().GetName(), event.GetRepo().GetName(), version, event.GetAfter(), saveTag); err != nil {
+					return err
+				}
+
+				auditStoredVersion(ctx, tx, saveTag)
+
+				return nil
+			})
 		})
 	default:
 		return fmt.Errorf("invalid webhook type")
 	}
 }
 
-func (GithubProvider) RegisterCustomHTTPHandlers(router *httprouter.Router) {
-
-}
-
 func (g GithubProvider) updateAllTags(ctx context.Context, owner string, repo string) error {
-	return db.Batch(func(tx *bolt.Tx) error {
+	return tracedBatch(ctx, "github tags", func(tx *bolt.Tx) error {
 		page := 1
 
 		for {
@@ -107,7 +125,7 @@ func (g GithubProvider) updateAllTags(ctx context.Context, owner string, repo st
 				saveTag := g.generateSaveTag(owner, repo, tag.GetName())
 
 				if err := g.addOrUpdate(ctx, tx, owner, repo, tag.GetName(), tag.GetCommit().GetSHA(), saveTag); err != nil {
-					log.Errorf("cannot update tag %s of %s/%s\n", tag.GetName(), owner, repo)
+					log.WithContext(ctx).WithFields(log.Fields{"provider": g.provider.Name, "project": owner + "/" + repo, "version": tag.GetName(), "ref": tag.GetCommit().GetSHA()}).WithError(err).Error("cannot update tag")
 				}
 			}
 
@@ -127,7 +145,7 @@ func (g GithubProvider) generateSaveTag(owner string, repo string, tag string) s
 }
 
 func (g GithubProvider) updateAllBranches(ctx context.Context, owner string, repo string) error {
-	return db.Batch(func(tx *bolt.Tx) error {
+	return tracedBatch(ctx, "github branches", func(tx *bolt.Tx) error {
 		page := 1
 
 		for {
@@ -141,7 +159,7 @@ func (g GithubProvider) updateAllBranches(ctx context.Context, owner string, rep
 				saveTag := g.generateSaveTag(owner, repo, branch.GetName())
 
 				if err := g.addOrUpdate(ctx, tx, owner, repo, branch.GetName(), branch.GetCommit().GetSHA(), saveTag); err != nil {
-					log.Errorf("cannot update branch %s of %s/%s\n", branch.GetName(), owner, repo)
+					log.WithContext(ctx).WithFields(log.Fields{"provider": g.provider.Name, "project": owner + "/" + repo, "version": branch.GetName(), "ref": branch.GetCommit().GetSHA()}).WithError(err).Error("cannot update branch")
 				}
 			}
 
@@ -157,7 +175,7 @@ func (g GithubProvider) updateAllBranches(ctx context.Context, owner string, rep
 }
 
 func (g GithubProvider) addOrUpdate(ctx context.Context, tx *bolt.Tx, owner, repo, version, sha, saveTag string) error {
-	log.Infof("updating info of %s/%s for version %s\n", owner, repo, version)
+	log.WithContext(ctx).WithFields(log.Fields{"provider": g.provider.Name, "project": owner + "/" + repo, "version": version, "ref": sha}).Info("updating version")
 
 	file, _, _, err := g.client.Repositories.GetContents(ctx, owner, repo, "composer.json", &github.RepositoryContentGetOptions{Ref: sha})
 
@@ -171,5 +189,15 @@ func (g GithubProvider) addOrUpdate(ctx context.Context, tx *bolt.Tx, owner, rep
 		return err
 	}
 
-	return addOrUpdateVersion(tx, []byte(content), version, fmt.Sprintf("https://api.github.com/repos/%s/%s/zipball/%s", owner, repo, sha), saveTag)
+	released := storedReleaseTime(tx, saveTag, sha)
+	if released.IsZero() {
+		commit, _, err := g.client.Repositories.GetCommit(ctx, owner, repo, sha, nil)
+		if err != nil {
+			return err
+		}
+
+		released = commit.GetCommit().GetCommitter().GetDate().Time
+	}
+
+	return addOrUpdateVersion(tx, []byte(content), version, fmt.Sprintf("https://api.github.com/repos/%s/%s/zipball/%s", owner, repo, sha), saveTag, g.provider.Name, released)
 }
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 	"github.com/xanzy/go-gitlab"
 	bolt "go.etcd.io/bbolt"
@@ -19,26 +20,30 @@ type GitlabProvider struct {
 	git      *gitlab.Client
 }
 
-func NewGitlabProvider(provider ConfigProvider) GitlabProvider {
-	var err error
-	git, err := gitlab.NewClient(provider.Token, gitlab.WithBaseURL(fmt.Sprintf("https://%s/api/v4", provider.Domain)))
+func NewGitlabProvider(provider ConfigProvider) (GitlabProvider, error) {
+	git, err := gitlab.NewClient(provider.Token, gitlab.WithBaseURL(fmt.Sprintf("https://%s/api/v4", provider.Domain)), gitlab.WithHTTPClient(tracedHTTPClient(&http.Client{})))
 	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+		return GitlabProvider{}, fmt.Errorf("cannot create gitlab client: %w", err)
 	}
 
-	return GitlabProvider{Provider: provider, git: git}
+	return GitlabProvider{Provider: provider, git: git}, nil
 }
 
 func (g GitlabProvider) GetConfig() ConfigProvider {
 	return g.Provider
 }
 
-func (g GitlabProvider) UpdateAll() error {
+func (g GitlabProvider) UpdateAll(ctx context.Context) error {
 	for _, project := range g.Provider.Projects {
-		if err := g.updateAllTags(project.Name); err != nil {
-			return err
-		}
-		if err := g.updateAllBranches(project.Name); err != nil {
+		err := observeSync(ctx, g.Provider.Name, project.Name, func(ctx context.Context) error {
+			if err := g.updateAllTags(ctx, project.Name); err != nil {
+				return err
+			}
+
+			return g.updateAllBranches(ctx, project.Name)
+		})
+
+		if err != nil {
 			return err
 		}
 	}
@@ -47,8 +52,10 @@ func (g GitlabProvider) UpdateAll() error {
 }
 
 func (g GitlabProvider) Webhook(request *http.Request) error {
-	if request.Header.Get("X-Gitlab-Token") != g.Provider.WebhookSecret {
-		return fmt.Errorf("forbidden")
+	// without a secret, webhooks are accepted like before secrets could be hashed
+	hasSecret := g.Provider.WebhookSecret != "" || g.Provider.WebhookSecretHash != ""
+	if hasSecret && !matchesSecret(request.Header.Get("X-Gitlab-Token"), g.Provider.WebhookSecret, g.Provider.WebhookSecretHash) {
+		return errWebhookSecret
 	}
 
 	var event gitlab.PushEvent
@@ -70,11 +77,22 @@ func (g GitlabProvider) Webhook(request *http.Request) error {
 
 	saveTag := g.generateSaveTag(event.ProjectID, trimmedVersion)
 
-	return db.Update(func(tx *bolt.Tx) error {
-		if event.After == "0000000000000000000000000000000000000000" {
-			return deleteVersion(tx, saveTag)
-		}
-		return g.addOrUpdate(tx, strconv.FormatInt(int64(event.ProjectID), 10), version, event.CheckoutSHA, saveTag)
+	// the request is already answered when the push is queued during a sync, ctx is the one of the sync then
+	return app.applyWebhook(request.Context(), g.Provider.Name, func(ctx context.Context) error {
+		return tracedUpdate(ctx, "gitlab webhook", func(tx *bolt.Tx) error {
+			if event.After == "0000000000000000000000000000000000000000" {
+				auditStoredVersion(ctx, tx, saveTag)
+				return deleteVersion(tx, saveTag)
+			}
+
+			if err := g.addOrUpdate(ctx, tx, strconv.FormatInt(int64(event.ProjectID), 10), version, event.CheckoutSHA, saveTag, nil); err != nil {
+				return err
+			}
+
+			auditStoredVersion(ctx, tx, saveTag)
+
+			return nil
+		})
 	})
 }
 
@@ -82,35 +100,31 @@ func (g GitlabProvider) generateSaveTag(projectID int, trimmedVersion string) st
 	return fmt.Sprintf("%d-%s", projectID, trimmedVersion)
 }
 
-func (GitlabProvider) RegisterCustomHTTPHandlers(router *httprouter.Router) {
-
-}
-
-func (g GitlabProvider) updateAllBranches(gitlabId string) error {
-	project, _, err := g.git.Projects.GetProject(gitlabId, &gitlab.GetProjectOptions{})
+func (g GitlabProvider) updateAllBranches(ctx context.Context, gitlabId string) error {
+	project, _, err := g.git.Projects.GetProject(gitlabId, &gitlab.GetProjectOptions{}, gitlab.WithContext(ctx))
 
 	if err != nil {
 		return err
 	}
 
-	return db.Batch(func(tx *bolt.Tx) error {
+	return tracedBatch(ctx, "gitlab branches", func(tx *bolt.Tx) error {
 		page := 1
 
 		for {
 			branches, _, err := g.git.Branches.ListBranches(gitlabId, &gitlab.ListBranchesOptions{
 				ListOptions: gitlab.ListOptions{PerPage: 100, Page: page},
-			})
+			}, gitlab.WithContext(ctx))
 
 			if err != nil {
 				return err
 			}
 
 			for _, branch := range branches {
-				log.Printf("Fetching infos for repo %s and branch: %s\n", gitlabId, branch.Name)
+				log.WithContext(ctx).WithFields(log.Fields{"provider": g.Provider.Name, "project": gitlabId, "version": branch.Name, "ref": branch.Commit.ShortID}).Info("updating branch")
 
 				saveTag := g.generateSaveTag(project.ID, branch.Name)
 
-				if err := g.addOrUpdate(tx, strconv.FormatInt(int64(project.ID), 10), strings.ToLower(fmt.Sprintf("dev-%s", branch.Name)), branch.Commit.ShortID, saveTag); err != nil {
+				if err := g.addOrUpdate(ctx, tx, strconv.FormatInt(int64(project.ID), 10), strings.ToLower(fmt.Sprintf("dev-%s", branch.Name)), branch.Commit.ShortID, saveTag, branch.Commit.CommittedDate); err != nil {
 					return err
 				}
 			}
@@ -125,29 +139,29 @@ func (g GitlabProvider) updateAllBranches(gitlabId string) error {
 	})
 }
 
-func (g GitlabProvider) updateAllTags(gitlabId string) error {
-	project, _, err := g.git.Projects.GetProject(gitlabId, &gitlab.GetProjectOptions{})
+func (g GitlabProvider) updateAllTags(ctx context.Context, gitlabId string) error {
+	project, _, err := g.git.Projects.GetProject(gitlabId, &gitlab.GetProjectOptions{}, gitlab.WithContext(ctx))
 
 	if err != nil {
 		return err
 	}
 
-	return db.Batch(func(tx *bolt.Tx) error {
+	return tracedBatch(ctx, "gitlab tags", func(tx *bolt.Tx) error {
 		page := 1
 
 		for {
 			tags, _, err := g.git.Tags.ListTags(gitlabId, &gitlab.ListTagsOptions{
 				ListOptions: gitlab.ListOptions{PerPage: 100, Page: page},
-			})
+			}, gitlab.WithContext(ctx))
 
 			if err != nil {
 				return err
 			}
 
 			for _, tag := range tags {
-				log.Printf("Fetching infos for repo %s and tag: %s\n", gitlabId, tag.Name)
+				log.WithContext(ctx).WithFields(log.Fields{"provider": g.Provider.Name, "project": gitlabId, "version": tag.Name, "ref": tag.Commit.ShortID}).Info("updating tag")
 				saveTag := g.generateSaveTag(project.ID, tag.Name)
-				if err := g.addOrUpdate(tx, strconv.FormatInt(int64(project.ID), 10), strings.ToLower(tag.Name), tag.Commit.ShortID, saveTag); err != nil {
+				if err := g.addOrUpdate(ctx, tx, strconv.FormatInt(int64(project.ID), 10), strings.ToLower(tag.Name), tag.Commit.ShortID, saveTag, tag.Commit.CommittedDate); err != nil {
 					return err
 				}
 			}
@@ -162,8 +176,9 @@ func (g GitlabProvider) updateAllTags(gitlabId string) error {
 	})
 }
 
-func (g GitlabProvider) addOrUpdate(tx *bolt.Tx, pid, version, sha, saveTag string) error {
-	file, _, err := g.git.RepositoryFiles.GetFile(pid, "composer.json", &gitlab.GetFileOptions{Ref: &sha})
+// addOrUpdate stores the version of a commit, without a commit date it is fetched from the API.
+func (g GitlabProvider) addOrUpdate(ctx context.Context, tx *bolt.Tx, pid, version, sha, saveTag string, committed *time.Time) error {
+	file, _, err := g.git.RepositoryFiles.GetFile(pid, "composer.json", &gitlab.GetFileOptions{Ref: &sha}, gitlab.WithContext(ctx))
 
 	if err != nil {
 		return err
@@ -171,5 +186,23 @@ func (g GitlabProvider) addOrUpdate(tx *bolt.Tx, pid, version, sha, saveTag stri
 
 	bytes, _ := base64.StdEncoding.DecodeString(file.Content)
 
-	return addOrUpdateVersion(tx, bytes, version, fmt.Sprintf("https://%s/api/v4/projects/%s/repository/archive.zip?sha=%s", g.Provider.Domain, pid, sha), saveTag)
+	if committed == nil {
+		if released := storedReleaseTime(tx, saveTag, sha); !released.IsZero() {
+			committed = &released
+		} else {
+			commit, _, err := g.git.Commits.GetCommit(pid, sha, gitlab.WithContext(ctx))
+			if err != nil {
+				return err
+			}
+
+			committed = commit.CommittedDate
+		}
+	}
+
+	var released time.Time
+	if committed != nil {
+		released = *committed
+	}
+
+	return addOrUpdateVersion(tx, bytes, version, fmt.Sprintf("https://%s/api/v4/projects/%s/repository/archive.zip?sha=%s", g.Provider.Domain, pid, sha), saveTag, g.Provider.Name, released)
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+func listPackagesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := authorizeRequest(w, r, scopeRead)
+
+	if user == nil {
+		return
+	}
+
+	packageType := r.URL.Query().Get("type")
+	vendor := strings.ToLower(r.URL.Query().Get("vendor"))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	packageNames := make([]string, 0)
+
+	err := app.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("packages")).Cursor()
+
+		prefix := []byte("search--")
+		if vendor != "" {
+			prefix = []byte("search--" + vendor + "/")
+		}
+
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var entry SearchIndexEntry
+
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+
+			if packageType != "" && entry.Type != packageType {
+				continue
+			}
+
+			if !user.HasAccessToPackage(entry.Name) {
+				continue
+			}
+
+			packageNames = append(packageNames, entry.Name)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithContext(r.Context()).Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{"packageNames": packageNames})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestInfo is shared by the handlers of a request, so the access log knows who made it.
+type requestInfo struct {
+	ID       string
+	Identity string
+
+	// user is the result of validateRequest, the rate limits and the handler authenticate only once
+	user          *ConfigUser
+	authenticated bool
+
+	// route is the registered path of the matched route
+	route string
+}
+
+type requestInfoKey struct{}
+
+var accessLog = struct {
+	sync.Mutex
+	writer io.Writer
+	logger *log.Logger
+	file   *os.File
+	format string
+}{}
+
+// setupLogging applies the log level and format, and opens the access log. It is applied again when the
+// config is reloaded.
+func setupLogging(config ConfigLog) error {
+	level := log.InfoLevel
+	if config.Level != "" {
+		parsed, err := log.ParseLevel(config.Level)
+		if err != nil {
+			return err
+		}
+
+		level = parsed
+	}
+
+	log.SetLevel(level)
+
+	if config.Format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	}
+
+	accessLog.Lock()
+	defer accessLog.Unlock()
+
+	var file *os.File
+	var writer io.Writer = os.Stdout
+
+	if config.AccessLog != "" && config.AccessLogFile != "" {
+		var err error
+		if file, err = os.OpenFile(config.AccessLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+			return err
+		}
+
+		writer = file
+	}
+
+	if accessLog.file != nil {
+		accessLog.file.Close()
+	}
+
+	accessLog.format = config.AccessLog
+	accessLog.writer = writer
+	accessLog.file = file
+	accessLog.logger = &log.Logger{Out: writer, Formatter: &log.JSONFormatter{}, Hooks: make(log.LevelHooks), Level: log.InfoLevel}
+
+	return nil
+}
+
+func init() {
+	log.AddHook(contextHook{})
+}
+
+func requestInfoOf(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+
+	return info
+}
+
+func requestID(ctx context.Context) string {
+	if info := requestInfoOf(ctx); info != nil {
+		return info.ID
+	}
+
+	return ""
+}
+
+// setRequestUser records who made the request for the access and the audit log, nil users are not recorded.
+func setRequestUser(r *http.Request, user *ConfigUser) {
+	if user != nil {
+		setRequestIdentity(r, user.Identity())
+	}
+}
+
+func setRequestIdentity(r *http.Request, identity string) {
+	if info := requestInfoOf(r.Context()); info != nil {
+		info.Identity = identity
+	}
+
+	if entry := auditEntryOf(r); entry != nil {
+		entry.Identity = identity
+	}
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// logged assigns every request an ID, which is returned in X-Request-Id and added to log lines, and writes
+// the access log. A valid X-Request-Id of the client is kept.
+func logged(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{ID: r.Header.Get("X-Request-Id")}
+		if !requestIDPattern.MatchString(info.ID) {
+			info.ID = newRequestID()
+		}
+
+		w.Header().Set("X-Request-Id", info.ID)
+
+		start := time.Now()
+		counter := &countingResponseWriter{ResponseWriter: w}
+
+		handler.ServeHTTP(counter, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		if counter.status == 0 {
+			counter.status = http.StatusOK
+		}
+
+		writeAccessLog(r, info, counter.status, counter.bytes, time.Since(start))
+	})
+}
+
+// writeAccessLog logs the request without its credentials, the user is only named by its identity.
+func writeAccessLog(r *http.Request, info *requestInfo, status int, bytes int64, duration time.Duration) {
+	accessLog.Lock()
+	defer accessLog.Unlock()
+
+	switch accessLog.format {
+	case "json":
+		accessLog.logger.WithFields(log.Fields{
+			"request_id":  info.ID,
+			"remote_addr": clientIP(r),
+			"user":        info.Identity,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"query":       r.URL.RawQuery,
+			"protocol":    r.Proto,
+			"status":      status,
+			"bytes":       bytes,
+			"duration_ms": duration.Milliseconds(),
+			"referer":     r.Referer(),
+			"user_agent":  r.UserAgent(),
+		}).Info("request")
+	case "combined":
+		user := info.Identity
+		if user == "" {
+			user = "-"
+		}
+
+		fmt.Fprintf(accessLog.writer, "%s - %s [%s] %s %d %d %s %s\n",
+			clientIP(r),
+			user,
+			time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(r.Method+" "+r.URL.RequestURI()+" "+r.Proto),
+			status,
+			bytes,
+			strconv.Quote(r.Referer()),
+			strconv.Quote(r.UserAgent()),
+		)
+	}
+}
+
+// contextHook adds the request ID and the trace of the context to log lines written with log.WithContext.
+type contextHook struct{}
+
+func (contextHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (contextHook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+
+	if info := requestInfoOf(entry.Context); info != nil {
+		entry.Data["request_id"] = info.ID
+	}
+
+	if spanContext := trace.SpanContextFromContext(entry.Context); spanContext.IsValid() {
+		entry.Data["trace_id"] = spanContext.TraceID().String()
+		entry.Data["span_id"] = spanContext.SpanID().String()
+	}
+
+	return nil
+}
@@ -2,52 +2,106 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"sort"
 	"strings"
+	"syscall"
 
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
 )
 
-var config *Config
-var db *bolt.DB
-
 var configFile = "config.json"
 
 func main() {
 	flag.StringVar(&configFile, "config", configFile, "config file path")
 	flag.Parse()
 
+	if flag.Arg(0) == "generate-token" {
+		if err := runGenerateToken(flag.Args()[1:]); err != nil {
+			log.Fatalln(err)
+		}
+
+		return
+	}
+
 	if os.Getenv("COMPOSER_REGISTRY_CONFIG_PATH") != "" {
 		configFile = os.Getenv("COMPOSER_REGISTRY_CONFIG_PATH")
 	}
 
-	router := httprouter.New()
-	router.GET("/packages.json", packagesJsonHandler)
-	router.GET("/p/:owner/:repo/versions.json", singlePackageHandler)
-	router.POST("/webhook/:name", webhookHandler)
-	router.GET("/custom/:owner/:repo/:version/file.zip", handleCustomDownload)
+	if flag.Arg(0) == "validate" {
+		if err := runValidate(flag.Args()[1:]); err != nil {
+			log.Fatalln(err)
+		}
 
-	var err error
-	config, err = LoadConfig()
+		return
+	}
+
+	router := newRouter()
+	router.GET("/packages.json", audited("metadata", rateLimited(packagesJsonHandler)))
+	router.GET("/p/:owner/:repo/versions.json", audited("metadata", rateLimited(singlePackageHandler)))
+	router.POST("/webhook/:name", audited("webhook", throttledAuth(webhookHandler)))
+	router.GET("/custom/:owner/:repo/:version/file.zip", audited("download", rateLimited(handleCustomDownload)))
+	router.GET("/search.json", audited("metadata", rateLimited(searchHandler)))
+	router.GET("/packages/list.json", audited("metadata", rateLimited(listPackagesHandler)))
+	router.GET("/metadata/changes.json", audited("metadata", rateLimited(metadataChangesHandler)))
+	router.POST("/downloads/", rateLimited(notifyBatchHandler))
+	registerStatusHandlers(router)
+
+	config, err := LoadConfig()
 	if err != nil {
+		exitOnConfigError(err)
+	}
+
+	if err := setupLogging(config.Log); err != nil {
 		log.Fatalln(err)
 	}
 
-	db, err = bolt.Open(path.Join(config.StoragePath, "packages.db"), 0666, nil)
+	shutdownTracing, err := setupTracing(config.Tracing)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("packages"))
+	app.db, err = bolt.Open(path.Join(config.StoragePath, "packages.db"), 0666, nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte("packages")); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists([]byte("changes")); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists([]byte("tokens")); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists([]byte("audit")); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists([]byte("meta")); err != nil {
+			return err
+		}
+
+		if err := loadFingerprintKey(tx); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucketIfNotExists([]byte("stats"))
 		return err
 	})
 
@@ -55,16 +109,86 @@ func main() {
 		panic(err)
 	}
 
-	defer db.Close()
+	if err := openAuditLog(config.Audit); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := rebuildSearchIndex(); err != nil {
+		log.WithError(err).Error("cannot rebuild search index")
+	}
+
+	if err := loadPackageProviders(); err != nil {
+		log.WithError(err).Error("cannot load package providers")
+	}
+
+	// cancelled on SIGTERM or SIGINT, running syncs stop and the servers are shut down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErrs := make(chan error, 2)
+
+	scheduler, err := app.start(ctx, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	registerCustomProviderHandlers(router)
+	registerReloadHandlers(router)
+	registerTokenHandlers(router)
+	registerAuditHandlers(router)
+	registerStatisticsHandlers(router)
+
+	servers := []*http.Server{}
+	if metricsServer := registerMetrics(router, config.Metrics, serverErrs); metricsServer != nil {
+		servers = append(servers, metricsServer)
+	}
+
+	go func() {
+		updateAll(ctx, false)
+		initialSyncDone.Store(true)
+	}()
+	go cleanupRateLimits()
+
+	registerSignalHandlers(ctx)
+	go watchConfig(ctx)
+
+	server := &http.Server{Addr: config.BindAddress, Handler: tracedHandler(logged(instrumented(router)))}
+	servers = append(servers, server)
+
+	if config.TLS.CertFile != "" {
+		if server.TLSConfig, err = newTLSConfig(config.TLS); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	go func() {
+		if server.TLSConfig != nil {
+			log.WithField("address", config.BindAddress).Info("listening with TLS")
+			serverErrs <- server.ListenAndServeTLS("", "")
+			return
+		}
+
+		log.WithField("address", config.BindAddress).Info("listening")
+		serverErrs <- server.ListenAndServe()
+	}()
 
-	registerProviders(config, router)
+	exitCode := 0
 
-	go updateAll(false)
+	select {
+	case <-ctx.Done():
+	case err := <-serverErrs:
+		log.WithError(err).Error("server failed")
+		exitCode = 1
+	}
 
-	registerSignalHandlers()
+	stop()
 
-	log.Infof("Listing on %s", config.BindAddress)
-	log.Fatal(http.ListenAndServe(config.BindAddress, router))
+	if err := shutdown(servers, scheduler, shutdownTracing); err != nil {
+		log.WithError(err).Error("shutdown did not finish cleanly")
+		exitCode = 1
+	}
+
+	os.Exit(exitCode)
 }
 
 func webhookHandler(writer http.ResponseWriter, request *http.Request, ps httprouter.Params) {
@@ -74,28 +198,67 @@ func webhookHandler(writer http.ResponseWriter, request *http.Request, ps httpro
 	}
 
 	providerName := ps.ByName("name")
+	auditTarget(request, providerName)
 
-	if _, ok := providers[providerName]; !ok {
+	provider, ok := app.Provider(providerName)
+	if !ok {
 		http.Error(writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
-	log.Infof("Received webhook from %s", ps.ByName("name"))
+	if ip := clientIP(request); !provider.GetConfig().AllowsIP(ip) {
+		log.WithContext(request.Context()).WithFields(log.Fields{"provider": providerName, "ip": ip}).Info("rejected webhook, the address is not in allowed_ips")
+		webhookDeliveries.WithLabelValues(providerName, "rejected").Inc()
+		http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	ctx, span := startProviderSpan(request.Context(), "webhook "+providerName, providerName, "")
+	request = request.WithContext(ctx)
+
+	logger := log.WithContext(ctx).WithField("provider", providerName)
+	logger.Info("received webhook")
+
+	err := provider.Webhook(request)
+
+	queued := errors.Is(err, errWebhookQueued)
+	if queued {
+		err = nil
+	}
 
-	if err := providers[providerName].Webhook(request); err != nil {
-		log.Infof("Webhook error: %s", err)
+	endSpan(span, err)
+
+	if errors.Is(err, errWebhookSecret) {
+		logger.WithError(err).Info("rejected webhook")
+		webhookDeliveries.WithLabelValues(providerName, "rejected").Inc()
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if err != nil {
+		logger.WithError(err).Error("webhook failed")
+		webhookDeliveries.WithLabelValues(providerName, "failure").Inc()
 		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
+	// failed deliveries, e.g. with a wrong secret, stay without identity
+	setRequestIdentity(request, "provider:"+providerName)
+
+	if queued {
+		logger.Info("queued webhook until the running sync is done")
+		webhookDeliveries.WithLabelValues(providerName, "queued").Inc()
+		writer.WriteHeader(http.StatusAccepted)
+		return
+	}
+	webhookDeliveries.WithLabelValues(providerName, "success").Inc()
 	writer.WriteHeader(http.StatusOK)
 }
 
 func packagesJsonHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	user := validateRequest(r)
+	user := authorizeRequest(w, r, scopeRead)
 
 	if user == nil {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 
@@ -104,7 +267,7 @@ func packagesJsonHandler(w http.ResponseWriter, r *http.Request, ps httprouter.P
 
 	var availablePackagesIndexed = make(map[string]bool)
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := tracedView(r.Context(), "packages", func(tx *bolt.Tx) error {
 		c := tx.Bucket([]byte("packages")).Cursor()
 
 		prefix := []byte("packages--")
@@ -122,7 +285,7 @@ func packagesJsonHandler(w http.ResponseWriter, r *http.Request, ps httprouter.P
 	})
 
 	if err != nil {
-		log.Error(err)
+		log.WithContext(r.Context()).Error(err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -134,17 +297,16 @@ func packagesJsonHandler(w http.ResponseWriter, r *http.Request, ps httprouter.P
 
 	sort.Strings(availablePackages)
 
-	err = json.NewEncoder(w).Encode(map[string]interface{}{"metadata-url": "/p/%package%/versions.json", "available-packages": availablePackages})
+	err = json.NewEncoder(w).Encode(map[string]interface{}{"metadata-url": "/p/%package%/versions.json", "search": "/search.json?q=%query%&type=%type%", "list": "/packages/list.json", "metadata-changes-url": "/metadata/changes.json", "notify-batch": "/downloads/", "available-packages": availablePackages})
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
 
 func singlePackageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	user := validateRequest(r)
+	user := authorizeRequest(w, r, scopeRead)
 
 	if user == nil {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 
@@ -168,7 +330,7 @@ func singlePackageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.
 	singleResponse["minified"] = "composer/2.0"
 	versions := make([]map[string]interface{}, 0)
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := tracedView(r.Context(), "versions", func(tx *bolt.Tx) error {
 		c := tx.Bucket([]byte("packages")).Cursor()
 
 		prefix := []byte("packages--" + packageName + "|")
@@ -188,6 +350,11 @@ func singlePackageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.
 				return err
 			}
 
+			version := strings.TrimPrefix(string(k), packageName+"|")
+			if !user.HasAccessToVersion(packageName, version, versionReleaseTime(composerJson)) {
+				continue
+			}
+
 			versions = append(versions, composerJson)
 		}
 
@@ -208,10 +375,9 @@ func singlePackageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.
 }
 
 func handleCustomDownload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	user := validateRequest(r)
+	user := authorizeRequest(w, r, scopeDownload)
 
 	if user == nil {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 
@@ -222,7 +388,51 @@ func handleCustomDownload(w http.ResponseWriter, r *http.Request, ps httprouter.
 		return
 	}
 
-	zipFile := getZipPath(packageName, ps.ByName("version"))
+	version := ps.ByName("version")
 
-	http.ServeFile(w, r, zipFile)
+	if err := validatePackagePath(packageName, version); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	composerJson := map[string]interface{}{}
+	var zipFile string
+
+	err := tracedView(r.Context(), "dist", func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte("packages")).Get([]byte("packages--" + packageName + "|" + version))
+		if data == nil {
+			return nil
+		}
+
+		if err := json.Unmarshal(data, &composerJson); err != nil {
+			return err
+		}
+
+		var err error
+		zipFile, err = getDistPath(tx, packageName, version)
+
+		return err
+	})
+
+	if err != nil {
+		log.WithContext(r.Context()).Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if zipFile == "" || !user.HasAccessToVersion(packageName, version, versionReleaseTime(composerJson)) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	counter := &countingResponseWriter{ResponseWriter: w}
+	http.ServeFile(counter, r, zipFile)
+	servedBytes.Add(float64(counter.bytes))
+
+	// conditional and range requests are not counted as downloads
+	if counter.status == http.StatusOK {
+		if err := recordStatistic(statisticDownload, packageName, version, user.Identity()); err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"package": packageName, "version": version}).WithError(err).Error("cannot record download")
+		}
+	}
 }
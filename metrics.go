@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "composer_registry_http_requests_total",
+		Help: "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "composer_registry_http_request_duration_seconds",
+		Help:    "HTTP request latencies by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	authFailureRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "composer_registry_auth_failures_total",
+		Help: "Requests rejected as unauthorized or forbidden by route.",
+	}, []string{"route", "status"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "composer_registry_webhook_deliveries_total",
+		Help: "Webhook deliveries by provider and outcome.",
+	}, []string{"provider", "outcome"})
+
+	syncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "composer_registry_sync_duration_seconds",
+		Help:    "Duration of syncing a project of a provider.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"provider", "project"})
+
+	syncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "composer_registry_syncs_total",
+		Help: "Syncs of a project of a provider by result.",
+	}, []string{"provider", "project", "result"})
+
+	servedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "composer_registry_dist_served_bytes_total",
+		Help: "Bytes of dists served from the local storage.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(storageCollector{
+		packages: prometheus.NewDesc("composer_registry_packages", "Number of stored packages.", nil, nil),
+		versions: prometheus.NewDesc("composer_registry_versions", "Number of stored versions.", nil, nil),
+		size:     prometheus.NewDesc("composer_registry_database_size_bytes", "Size of the bbolt database.", nil, nil),
+	})
+}
+
+// storageCollector counts the stored packages when scraped, so the numbers are always in sync with the
+// database.
+type storageCollector struct {
+	packages *prometheus.Desc
+	versions *prometheus.Desc
+	size     *prometheus.Desc
+}
+
+func (c storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.packages
+	ch <- c.versions
+	ch <- c.size
+}
+
+func (c storageCollector) Collect(ch chan<- prometheus.Metric) {
+	if app.db == nil {
+		return
+	}
+
+	err := app.db.View(func(tx *bolt.Tx) error {
+		packages, versions := 0, 0
+		lastPackage := ""
+
+		prefix := []byte("packages--")
+		cursor := tx.Bucket([]byte("packages")).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			versions++
+
+			if name, _, _ := strings.Cut(string(k[len(prefix):]), "|"); name != lastPackage {
+				packages++
+				lastPackage = name
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.packages, prometheus.GaugeValue, float64(packages))
+		ch <- prometheus.MustNewConstMetric(c.versions, prometheus.GaugeValue, float64(versions))
+		ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(tx.Size()))
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithError(err).Error("cannot collect storage metrics")
+	}
+}
+
+// Router registers the routes on the httprouter and remembers the registered path of the matched route in
+// the request info, so metrics and traces use /p/:owner/:repo/versions.json instead of the requested path.
+type Router struct {
+	*httprouter.Router
+}
+
+func newRouter() *Router {
+	return &Router{Router: httprouter.New()}
+}
+
+func (router *Router) Handle(method, path string, handle httprouter.Handle) {
+	router.Router.Handle(method, path, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if info := requestInfoOf(r.Context()); info != nil {
+			info.route = path
+		}
+
+		handle(w, r, ps)
+	})
+}
+
+func (router *Router) Handler(method, path string, handler http.Handler) {
+	router.Handle(method, path, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (router *Router) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	router.Handler(method, path, handler)
+}
+
+func (router *Router) GET(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodGet, path, handle)
+}
+
+func (router *Router) HEAD(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodHead, path, handle)
+}
+
+func (router *Router) OPTIONS(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodOptions, path, handle)
+}
+
+func (router *Router) POST(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodPost, path, handle)
+}
+
+func (router *Router) PUT(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodPut, path, handle)
+}
+
+func (router *Router) PATCH(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodPatch, path, handle)
+}
+
+func (router *Router) DELETE(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodDelete, path, handle)
+}
+
+// instrumented records the requests of the router. The route label is the registered path, so package
+// names and versions do not create new series. Requests without a route, e.g. 404s and redirects, are
+// unmatched.
+func instrumented(router *Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		counter := &countingResponseWriter{ResponseWriter: w}
+
+		router.ServeHTTP(counter, r)
+
+		if counter.status == 0 {
+			counter.status = http.StatusOK
+		}
+
+		route := "unmatched"
+		if info := requestInfoOf(r.Context()); info != nil && info.route != "" {
+			route = info.route
+		}
+
+		status := strconv.Itoa(counter.status)
+
+		// the span is started before the request is routed
+		trace.SpanFromContext(r.Context()).SetName(r.Method + " " + route)
+
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+
+		if counter.status == http.StatusUnauthorized || counter.status == http.StatusForbidden {
+			authFailureRequests.WithLabelValues(route, status).Inc()
+		}
+	})
+}
+
+// observeSync records the duration and the result of syncing a project of a provider, failures are shown in
+// the status of the provider.
+func observeSync(ctx context.Context, provider, project string, sync func(context.Context) error) error {
+	ctx, span := startProviderSpan(ctx, "sync project", provider, project)
+	start := time.Now()
+	err := sync(ctx)
+	endSpan(span, err)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+		recordProjectError(provider, fmt.Errorf("%s: %w", project, err))
+	}
+
+	syncDuration.WithLabelValues(provider, project).Observe(time.Since(start).Seconds())
+	syncs.WithLabelValues(provider, project, result).Inc()
+
+	return err
+}
+
+// metricsHandler serves the metrics, protected by a bearer token when one is configured.
+func metricsHandler() http.Handler {
+	handler := promhttp.Handler()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := app.Config().Metrics
+
+		if config.Token != "" || config.TokenHash != "" {
+			if !matchesSecret(bearerToken(r), config.Token, config.TokenHash) {
+				unauthorized(w)
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// registerMetrics serves /metrics on the main router, or on its own address when configured. The server of
+// that address is returned for the shutdown, errors of it are sent to errs.
+func registerMetrics(router *Router, config ConfigMetrics, errs chan<- error) *http.Server {
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.BindAddress == "" {
+		router.Handler(http.MethodGet, "/metrics", metricsHandler())
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+
+	server := &http.Server{Addr: config.BindAddress, Handler: mux}
+
+	go func() {
+		log.WithField("address", config.BindAddress).Info("serving metrics")
+		errs <- server.ListenAndServe()
+	}()
+
+	return server
+}
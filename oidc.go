@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	jwksCacheTTL        = time.Hour
+	jwksRefreshInterval = time.Minute
+)
+
+var oidcSignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+type jwksCacheEntry struct {
+	keys      *jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+// jwksLoad is a key set being loaded, requests for the same source wait for it instead of loading it again.
+type jwksLoad struct {
+	done chan struct{}
+	keys *jose.JSONWebKeySet
+	err  error
+}
+
+// jwksCache is only locked to read and swap entries, the key sets are loaded without holding it, so a slow
+// issuer does not block the logins of the others.
+var jwksCache = struct {
+	sync.Mutex
+	entries map[string]jwksCacheEntry
+	loading map[string]*jwksLoad
+}{entries: make(map[string]jwksCacheEntry), loading: make(map[string]*jwksLoad)}
+
+func looksLikeJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+// validateJWT verifies the token against the configured issuers and returns a user with the rules of
+// all matching claim mappings. Tokens without any matching mapping are rejected.
+func validateJWT(raw string) *ConfigUser {
+	token, err := jwt.ParseSigned(raw, oidcSignatureAlgorithms)
+	if err != nil {
+		return nil
+	}
+
+	var unverified jwt.Claims
+	if err := token.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return nil
+	}
+
+	for _, issuer := range app.Config().OIDC {
+		if issuer.Issuer != unverified.Issuer {
+			continue
+		}
+
+		user, err := issuer.authenticate(token)
+		if err != nil {
+			log.WithField("issuer", issuer.Issuer).WithError(err).Info("oidc: rejected token")
+			return nil
+		}
+
+		return user
+	}
+
+	return nil
+}
+
+func (o ConfigOIDC) authenticate(token *jwt.JSONWebToken) (*ConfigUser, error) {
+	if len(token.Headers) != 1 {
+		return nil, fmt.Errorf("expected exactly one signature")
+	}
+
+	key, err := o.key(token.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwt.Claims
+	var rawClaims map[string]interface{}
+	if err := token.Claims(key, &claims, &rawClaims); err != nil {
+		return nil, err
+	}
+
+	if claims.Expiry == nil {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+
+	err = claims.Validate(jwt.Expected{Issuer: o.Issuer, AnyAudience: jwt.Audience{o.Audience}})
+	if err != nil {
+		return nil, err
+	}
+
+	user := &ConfigUser{Username: claims.Subject, Rules: make([]ConfigUserRule, 0), identity: "oidc:" + o.Issuer + "#" + claims.Subject}
+	matched := false
+
+	for _, mapping := range o.Mappings {
+		value, ok := rawClaims[mapping.Claim].(string)
+		if !ok || (mapping.Value != "" && mapping.Value != value) {
+			continue
+		}
+
+		matched = true
+		user.Scopes = append(user.Scopes, mapping.Scopes...)
+
+		user.Rules = append(user.Rules, claimRules(mapping.Rules, value)...)
+		user.PublishRules = append(user.PublishRules, claimRules(mapping.PublishRules, value)...)
+	}
+
+	if !matched {
+		return nil, fmt.Errorf("no claim mapping matches subject %s", claims.Subject)
+	}
+
+	// the claim value may have changed regex rules, so they have to be compiled again
+	if err := compileRules(user.Rules); err != nil {
+		return nil, err
+	}
+
+	if err := compileRules(user.PublishRules); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// claimRules replaces the placeholder {value} in the rule values with the claim value.
+func claimRules(rules []ConfigUserRule, value string) []ConfigUserRule {
+	replaced := make([]ConfigUserRule, 0, len(rules))
+
+	for _, rule := range rules {
+		if rule.Type == "regex" {
+			rule.Value = strings.ReplaceAll(rule.Value, "{value}", regexp.QuoteMeta(value))
+		} else {
+			rule.Value = strings.ReplaceAll(rule.Value, "{value}", value)
+		}
+
+		replaced = append(replaced, rule)
+	}
+
+	return replaced
+}
+
+// key returns the signing key with the given id. An unknown id refreshes the key set, as the issuer may
+// have rotated its keys.
+func (o ConfigOIDC) key(kid string) (*jose.JSONWebKey, error) {
+	keys, err := o.keySet(false)
+	if err != nil {
+		return nil, err
+	}
+
+	if found := keys.Key(kid); len(found) > 0 {
+		return &found[0], nil
+	}
+
+	keys, err = o.keySet(true)
+	if err != nil {
+		return nil, err
+	}
+
+	if found := keys.Key(kid); len(found) > 0 {
+		return &found[0], nil
+	}
+
+	return nil, fmt.Errorf("unknown key id %s", kid)
+}
+
+func (o ConfigOIDC) keySet(refresh bool) (*jose.JSONWebKeySet, error) {
+	source := o.JWKSFile
+	if source == "" {
+		source = o.JWKSURL
+	}
+
+	jwksCache.Lock()
+
+	entry, ok := jwksCache.entries[source]
+	age := time.Since(entry.fetchedAt)
+
+	if ok && age < jwksCacheTTL && (!refresh || age < jwksRefreshInterval) {
+		jwksCache.Unlock()
+		return entry.keys, nil
+	}
+
+	load, loading := jwksCache.loading[source]
+	if !loading {
+		load = &jwksLoad{done: make(chan struct{})}
+		jwksCache.loading[source] = load
+	}
+
+	jwksCache.Unlock()
+
+	if loading {
+		<-load.done
+	} else {
+		load.keys, load.err = o.loadKeySet()
+
+		jwksCache.Lock()
+		delete(jwksCache.loading, source)
+		if load.err == nil {
+			jwksCache.entries[source] = jwksCacheEntry{keys: load.keys, fetchedAt: time.Now()}
+		}
+		jwksCache.Unlock()
+
+		close(load.done)
+	}
+
+	if load.err != nil {
+		if ok {
+			log.WithField("issuer", o.Issuer).WithError(load.err).Error("oidc: cannot refresh keys, using cached keys")
+			return entry.keys, nil
+		}
+
+		return nil, load.err
+	}
+
+	return load.keys, nil
+}
+
+func (o ConfigOIDC) loadKeySet() (*jose.JSONWebKeySet, error) {
+	var data []byte
+	var err error
+
+	if o.JWKSFile != "" {
+		data, err = os.ReadFile(o.JWKSFile)
+	} else {
+		data, err = fetchJWKS(o.JWKSURL)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+
+	return &keys, nil
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot fetch %s: %s", url, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
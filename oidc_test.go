@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+func TestKeySetRefreshDoesNotBlockOtherIssuers(t *testing.T) {
+	var fetches atomic.Int32
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		w.Write([]byte(`{"keys": []}`))
+	}))
+	defer server.Close()
+
+	slow := ConfigOIDC{Issuer: "https://slow.example.com", JWKSURL: server.URL}
+	cached := ConfigOIDC{Issuer: "https://cached.example.com", JWKSURL: "https://cached.example.com/jwks"}
+
+	jwksCache.Lock()
+	jwksCache.entries[cached.JWKSURL] = jwksCacheEntry{keys: &jose.JSONWebKeySet{}, fetchedAt: time.Now()}
+	jwksCache.Unlock()
+
+	t.Cleanup(func() {
+		jwksCache.Lock()
+		delete(jwksCache.entries, cached.JWKSURL)
+		delete(jwksCache.entries, slow.JWKSURL)
+		jwksCache.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := slow.keySet(true); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// the slow issuer is fetching now
+	for fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		if _, err := cached.keySet(false); err != nil {
+			t.Error(err)
+		}
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the cached issuer waited for the fetch of another issuer")
+	}
+
+	close(release)
+	wg.Wait()
+
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("expected concurrent refreshes to fetch the key set once, got %d fetches", got)
+	}
+}
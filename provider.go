@@ -1,63 +1,57 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 
-	"github.com/go-co-op/gocron/v2"
-	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 )
 
 type TypeProvider interface {
 	GetConfig() ConfigProvider
-	UpdateAll() error
+	UpdateAll(context.Context) error
 	Webhook(*http.Request) error
-	RegisterCustomHTTPHandlers(*httprouter.Router)
 }
 
-var providers = make(map[string]TypeProvider)
-
-func registerProviders(config *Config, router *httprouter.Router) {
-	s, _ := gocron.NewScheduler()
-
-	registeredProviders := make(map[string]bool)
-
-	for _, provider := range config.Providers {
-		switch provider.Type {
-		case "gitlab":
-			providers[provider.Name] = NewGitlabProvider(provider)
-		case "github":
-			providers[provider.Name] = NewGithubProvider(provider)
-		case "shopware":
-			providers[provider.Name] = NewShopwareProvider(provider)
-		case "custom":
-			providers[provider.Name] = NewCustomProvider(provider)
-		}
-
-		if _, ok := registeredProviders[provider.Type]; !ok {
-			providers[provider.Name].RegisterCustomHTTPHandlers(router)
-
-			registeredProviders[provider.Type] = true
-		}
+// ProviderChanges lists the providers a config reload added, replaced or removed.
+type ProviderChanges struct {
+	Added   []string `json:"added"`
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+}
 
-		if provider.CronSchedule != "" {
-			s.NewJob(
-				gocron.CronJob(provider.CronSchedule, false),
-				gocron.NewTask(providers[provider.Name].UpdateAll),
-				gocron.WithTags(provider.Name),
-			)
-		}
+func newProvider(provider ConfigProvider) (TypeProvider, error) {
+	switch provider.Type {
+	case "gitlab":
+		return NewGitlabProvider(provider)
+	case "github":
+		return NewGithubProvider(provider), nil
+	case "shopware":
+		return NewShopwareProvider(provider), nil
+	case "custom":
+		return NewCustomProvider(provider), nil
 	}
 
-	s.Start()
+	return nil, fmt.Errorf("unknown type %q", provider.Type)
 }
 
-func updateAll(force bool) {
-	for name, provider := range providers {
+func updateAll(ctx context.Context, force bool) {
+	for name, provider := range app.Providers() {
+		if ctx.Err() != nil {
+			return
+		}
+
 		if provider.GetConfig().FetchAllOnStart || force {
-			log.Infof("Updating all packages of %s", name)
-			if err := provider.UpdateAll(); err != nil {
-				log.Infof("Error updating all packages of %s: %s", name, err)
+			logger := log.WithContext(ctx).WithField("provider", name)
+			logger.Info("updating all packages")
+
+			err := syncProvider(ctx, name)
+			if errors.Is(err, errSyncRunning) {
+				logger.Info("skipped, a sync is already running")
+			} else if err != nil {
+				logger.WithError(err).Error("cannot update all packages")
 			}
 		}
 	}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+type rateLimitEntry struct {
+	limiter  *rate.Limiter
+	day      string
+	bytes    int64
+	lastSeen time.Time
+}
+
+type rateLimitKey struct {
+	key               string
+	requestsPerMinute int
+	bytesPerDay       int64
+}
+
+type authFailures struct {
+	count       int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+var rateLimits = struct {
+	sync.Mutex
+	entries  map[string]*rateLimitEntry
+	failures map[string]*authFailures
+}{entries: make(map[string]*rateLimitEntry), failures: make(map[string]*authFailures)}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+// rateLimited applies the configured request and traffic limits per token and per IP, and locks out IPs
+// after repeated authentication failures.
+func rateLimited(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		limits := app.Config().RateLimit
+		ip := clientIP(r)
+		now := time.Now()
+
+		if lockedUntil := lockedOut(ip, now); !lockedUntil.IsZero() {
+			tooManyRequests(w, lockedUntil.Sub(now))
+			return
+		}
+
+		keys := []rateLimitKey{{"ip:" + ip, limits.IPRequestsPerMinute, limits.IPBytesPerDay}}
+
+		// the token limits follow the authenticated identity, so the limits of a leaked token apply regardless
+		// of the IP and the header format it is used with. Failed authentications only count against the IP.
+		if user := validateRequest(r); user != nil && !user.anonymous {
+			keys = append(keys, rateLimitKey{"identity:" + user.Identity(), limits.RequestsPerMinute, limits.BytesPerDay})
+		}
+
+		for _, limit := range keys {
+			if retryAfter := takeRequest(limit.key, limit.requestsPerMinute, limit.bytesPerDay, now); retryAfter > 0 {
+				tooManyRequests(w, retryAfter)
+				return
+			}
+		}
+
+		counter := &countingResponseWriter{ResponseWriter: w}
+		handle(counter, r, ps)
+
+		for _, limit := range keys {
+			if limit.bytesPerDay > 0 {
+				addBytes(limit.key, counter.bytes, now)
+			}
+		}
+
+		if counter.status == http.StatusUnauthorized && r.Header.Get("Authorization") != "" {
+			recordAuthFailure(ip, now)
+		}
+	}
+}
+
+// throttledAuth rejects locked out IPs and counts every 401 as failed authentication, for the routes
+// without request limits guarded by the admin token, users or provider secrets.
+func throttledAuth(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ip := clientIP(r)
+		now := time.Now()
+
+		if lockedUntil := lockedOut(ip, now); !lockedUntil.IsZero() {
+			tooManyRequests(w, lockedUntil.Sub(now))
+			return
+		}
+
+		counter := &countingResponseWriter{ResponseWriter: w}
+		handle(counter, r, ps)
+
+		if counter.status == http.StatusUnauthorized {
+			recordAuthFailure(ip, now)
+		}
+	}
+}
+
+// takeRequest counts a request against the limits of the key and returns how long the client has to wait
+// when a limit is exceeded.
+func takeRequest(key string, requestsPerMinute int, bytesPerDay int64, now time.Time) time.Duration {
+	if requestsPerMinute <= 0 && bytesPerDay <= 0 {
+		return 0
+	}
+
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+
+	entry, ok := rateLimits.entries[key]
+	if !ok {
+		entry = &rateLimitEntry{}
+		rateLimits.entries[key] = entry
+	}
+
+	entry.lastSeen = now
+
+	if bytesPerDay > 0 {
+		if day := now.UTC().Format(time.DateOnly); entry.day != day {
+			entry.day = day
+			entry.bytes = 0
+		}
+
+		if entry.bytes >= bytesPerDay {
+			year, month, day := now.UTC().Date()
+
+			return time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC).Sub(now)
+		}
+	}
+
+	if requestsPerMinute > 0 {
+		if entry.limiter == nil {
+			entry.limiter = rate.NewLimiter(rate.Limit(float64(requestsPerMinute)/60), requestsPerMinute)
+		}
+
+		reservation := entry.limiter.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+
+			return delay
+		}
+	}
+
+	return 0
+}
+
+func addBytes(key string, bytes int64, now time.Time) {
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+
+	if entry, ok := rateLimits.entries[key]; ok && entry.day == now.UTC().Format(time.DateOnly) {
+		entry.bytes += bytes
+	}
+}
+
+func lockedOut(ip string, now time.Time) time.Time {
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+
+	if failures, ok := rateLimits.failures[ip]; ok && now.Before(failures.lockedUntil) {
+		return failures.lockedUntil
+	}
+
+	return time.Time{}
+}
+
+func recordAuthFailure(ip string, now time.Time) {
+	limits := app.Config().RateLimit
+	if limits.LockoutFailures <= 0 {
+		return
+	}
+
+	duration := time.Duration(limits.LockoutDuration) * time.Second
+
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+
+	failures, ok := rateLimits.failures[ip]
+	if !ok || now.Sub(failures.windowStart) > duration {
+		failures = &authFailures{windowStart: now}
+		rateLimits.failures[ip] = failures
+	}
+
+	failures.count++
+
+	if failures.count >= limits.LockoutFailures {
+		log.WithFields(log.Fields{"ip": ip, "duration": duration.String(), "failures": failures.count}).Warn("locking out after failed authentications")
+
+		failures.lockedUntil = now.Add(duration)
+		failures.count = 0
+		failures.windowStart = now
+	}
+}
+
+// cleanupRateLimits forgets idle clients, so the state does not grow with every IP ever seen.
+func cleanupRateLimits() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+
+		rateLimits.Lock()
+
+		for key, entry := range rateLimits.entries {
+			if now.Sub(entry.lastSeen) > 24*time.Hour {
+				delete(rateLimits.entries, key)
+			}
+		}
+
+		for ip, failures := range rateLimits.failures {
+			if now.After(failures.lockedUntil) && now.Sub(failures.windowStart) > time.Duration(app.Config().RateLimit.LockoutDuration)*time.Second {
+				delete(rateLimits.failures, ip)
+			}
+		}
+
+		rateLimits.Unlock()
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const configWatchInterval = 10 * time.Second
+
+// keepStartupOptions keeps the current values of the options that are only read on startup, so the config
+// matches what is running. The names of the changed options are returned.
+func keepStartupOptions(current, next *Config) []string {
+	var changed []string
+
+	keep := func(name string, running, loaded interface{}, restore func()) {
+		if !reflect.DeepEqual(running, loaded) {
+			changed = append(changed, name)
+			restore()
+		}
+	}
+
+	keep("bind_address", current.BindAddress, next.BindAddress, func() { next.BindAddress = current.BindAddress })
+	keep("storage_path", current.StoragePath, next.StoragePath, func() { next.StoragePath = current.StoragePath })
+	keep("tls", current.TLS, next.TLS, func() { next.TLS = current.TLS })
+	keep("metrics", current.Metrics, next.Metrics, func() { next.Metrics = current.Metrics })
+	keep("tracing", current.Tracing, next.Tracing, func() { next.Tracing = current.Tracing })
+	keep("audit.file", current.Audit.File, next.Audit.File, func() { next.Audit.File = current.Audit.File })
+
+	return changed
+}
+
+// watchConfig reloads the config when the file changed and watch_config is enabled, for systems without
+// SIGUSR1.
+func watchConfig(ctx context.Context) {
+	lastModified := configModified()
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		modified := configModified()
+		if modified.Equal(lastModified) || !app.Config().WatchConfig {
+			continue
+		}
+
+		lastModified = modified
+
+		log.WithField("file", configFile).Info("config file changed, reloading config")
+
+		if _, err := app.reload(); err != nil {
+			log.WithError(err).Error("cannot reload config")
+		}
+	}
+}
+
+func configModified() time.Time {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+func registerReloadHandlers(router *Router) {
+	router.POST("/admin/reload", audited("admin", throttledAuth(reloadHandler)))
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !validateAdminRequest(r) {
+		unauthorized(w)
+		return
+	}
+
+	changes, err := app.reload()
+	if err != nil {
+		log.WithContext(r.Context()).WithError(err).Error("cannot reload config")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": changes})
+}
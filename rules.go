@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// packageProviders maps package names to the name of the provider they came from, used by provider rules.
+var packageProviders sync.Map
+
+// compileRules validates the rules and precompiles regex rules, it has to be called before the rules are used.
+func compileRules(rules []ConfigUserRule) error {
+	for i := range rules {
+		rule := &rules[i]
+
+		switch rule.Type {
+		case "begins_with", "ends_with", "contains", "equals", "vendor", "provider":
+		case "glob":
+			if _, err := path.Match(rule.Value, ""); err != nil {
+				return fmt.Errorf("rules[%d]: invalid glob %q: %w", i, rule.Value, err)
+			}
+		case "regex":
+			regex, err := regexp.Compile(rule.Value)
+			if err != nil {
+				return fmt.Errorf("rules[%d]: invalid regex %q: %w", i, rule.Value, err)
+			}
+
+			rule.regex = regex
+		default:
+			return fmt.Errorf("rules[%d]: unknown rule type %q", i, rule.Type)
+		}
+
+		if rule.Value == "" {
+			return fmt.Errorf("rules[%d]: value is required", i)
+		}
+
+		if rule.Constraint != "" {
+			constraint, err := ParseVersionConstraint(rule.Constraint)
+			if err != nil {
+				return fmt.Errorf("rules[%d]: invalid constraint: %w", i, err)
+			}
+
+			rule.constraint = constraint
+		}
+
+		if rule.ReleasedBefore != "" {
+			releasedBefore, err := parseRuleDate(rule.ReleasedBefore)
+			if err != nil {
+				return fmt.Errorf("rules[%d]: invalid released_before date %q, use YYYY-MM-DD or RFC 3339", i, rule.ReleasedBefore)
+			}
+
+			rule.releasedBefore = releasedBefore
+		}
+	}
+
+	return nil
+}
+
+func (r ConfigUserRule) Matches(packageName string) bool {
+	switch r.Type {
+	case "begins_with":
+		return strings.HasPrefix(packageName, r.Value)
+	case "ends_with":
+		return strings.HasSuffix(packageName, r.Value)
+	case "contains":
+		return strings.Contains(packageName, r.Value)
+	case "equals":
+		return packageName == r.Value
+	case "glob":
+		matched, _ := path.Match(r.Value, packageName)
+		return matched
+	case "regex":
+		return r.regex != nil && r.regex.MatchString(packageName)
+	case "vendor":
+		vendor, _, _ := strings.Cut(packageName, "/")
+		return vendor == r.Value
+	case "provider":
+		provider, ok := packageProviders.Load(packageName)
+		return ok && provider == r.Value
+	}
+
+	return false
+}
+
+func parseRuleDate(value string) (time.Time, error) {
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		return date, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+func (r ConfigUserRule) limitsVersions() bool {
+	return r.Constraint != "" || r.ReleasedBefore != ""
+}
+
+// MatchesVersion checks the version limits of the rule, versions with an unknown release date never
+// match a released_before limit.
+func (r ConfigUserRule) MatchesVersion(version string, released time.Time) bool {
+	if r.Constraint != "" && (r.constraint == nil || !r.constraint.MatchesVersion(version)) {
+		return false
+	}
+
+	if r.ReleasedBefore != "" && (released.IsZero() || !released.Before(r.releasedBefore)) {
+		return false
+	}
+
+	return true
+}
+
+// HasAccessToPackage evaluates deny rules first, any matching deny rule rejects the package. Without allow
+// rules every other package is accessible, otherwise one of them has to match. Deny rules limited to some
+// versions only hide those versions, see HasAccessToVersion.
+func (c ConfigUser) HasAccessToPackage(packageName string) bool {
+	return rulesAllowPackage(c.Rules, packageName)
+}
+
+// CanChangePackage checks the publish rules for publishing and deleting a package, a user without publish
+// rules may change the packages it can read.
+func (c ConfigUser) CanChangePackage(packageName string) bool {
+	if len(c.PublishRules) > 0 {
+		return rulesAllowPackage(c.PublishRules, packageName)
+	}
+
+	return c.HasAccessToPackage(packageName)
+}
+
+func rulesAllowPackage(rules []ConfigUserRule, packageName string) bool {
+	hasAllowRules := false
+
+	for _, rule := range rules {
+		if rule.Deny {
+			if !rule.limitsVersions() && rule.Matches(packageName) {
+				return false
+			}
+
+			continue
+		}
+
+		hasAllowRules = true
+	}
+
+	if !hasAllowRules {
+		return true
+	}
+
+	for _, rule := range rules {
+		if !rule.Deny && rule.Matches(packageName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasAccessToVersion is like HasAccessToPackage, but also applies the version limits of the rules.
+func (c ConfigUser) HasAccessToVersion(packageName, version string, released time.Time) bool {
+	hasAllowRules := false
+
+	for _, rule := range c.Rules {
+		if rule.Deny {
+			if rule.Matches(packageName) && rule.MatchesVersion(version, released) {
+				return false
+			}
+
+			continue
+		}
+
+		hasAllowRules = true
+	}
+
+	if !hasAllowRules {
+		return true
+	}
+
+	for _, rule := range c.Rules {
+		if !rule.Deny && rule.Matches(packageName) && rule.MatchesVersion(version, released) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setPackageProvider records the provider of a package, the in-memory map is only updated once the
+// transaction is committed, so rolled back or retried batches do not leave stale entries.
+func setPackageProvider(tx *bolt.Tx, packageName, providerName string) error {
+	tx.OnCommit(func() { packageProviders.Store(packageName, providerName) })
+
+	bucket := tx.Bucket([]byte("packages"))
+	key := []byte("provider--" + packageName)
+
+	if string(bucket.Get(key)) == providerName {
+		return nil
+	}
+
+	return bucket.Put(key, []byte(providerName))
+}
+
+func removePackageProvider(tx *bolt.Tx, packageName string) error {
+	tx.OnCommit(func() { packageProviders.Delete(packageName) })
+
+	return tx.Bucket([]byte("packages")).Delete([]byte("provider--" + packageName))
+}
+
+func loadPackageProviders() error {
+	return app.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("packages")).Cursor()
+
+		prefix := []byte("provider--")
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			packageProviders.Store(string(bytes.TrimPrefix(k, prefix)), string(v))
+		}
+
+		return nil
+	})
+}
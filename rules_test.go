@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestCanChangePackage(t *testing.T) {
+	acme := []ConfigUserRule{{Type: "vendor", Value: "acme"}}
+	if err := compileRules(acme); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		user    ConfigUser
+		allowed map[string]bool
+	}{
+		{"publish rules", ConfigUser{PublishRules: acme}, map[string]bool{"acme/app": true, "other/app": false}},
+		{"read rules", ConfigUser{Rules: acme}, map[string]bool{"acme/app": true, "other/app": false}},
+		{"no rules", ConfigUser{}, map[string]bool{"acme/app": true, "other/app": true}},
+	}
+
+	for _, test := range tests {
+		for packageName, want := range test.allowed {
+			if got := test.user.CanChangePackage(packageName); got != want {
+				t.Errorf("%s: CanChangePackage(%q) = %v, want %v", test.name, packageName, got, want)
+			}
+		}
+	}
+
+	reader := ConfigUser{PublishRules: acme}
+	if !reader.HasAccessToPackage("other/app") {
+		t.Error("publish rules must not limit reading")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+type SearchIndexEntry struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Keywords    []string `json:"keywords"`
+	Type        string   `json:"type"`
+	Homepage    string   `json:"homepage"`
+	Repository  string   `json:"repository"`
+	Abandoned   any      `json:"abandoned,omitempty"`
+
+	// Version is the version the entry was taken from
+	Version string `json:"version"`
+}
+
+// searchIndexRevision changes when the stored entries change, the index is rebuilt once for a new revision.
+const searchIndexRevision = "2"
+
+type SearchResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	Repository  string `json:"repository"`
+	Downloads   int    `json:"downloads"`
+	Favers      int    `json:"favers"`
+	Abandoned   any    `json:"abandoned,omitempty"`
+}
+
+func newSearchIndexEntry(composerJson map[string]interface{}) SearchIndexEntry {
+	entry := SearchIndexEntry{Keywords: make([]string, 0)}
+
+	entry.Name, _ = composerJson["name"].(string)
+	entry.Description, _ = composerJson["description"].(string)
+	entry.Type, _ = composerJson["type"].(string)
+	entry.Homepage, _ = composerJson["homepage"].(string)
+	entry.Abandoned = composerJson["abandoned"]
+
+	if support, ok := composerJson["support"].(map[string]interface{}); ok {
+		entry.Repository, _ = support["source"].(string)
+	}
+
+	if entry.Type == "" {
+		entry.Type = "library"
+	}
+
+	if keywords, ok := composerJson["keywords"].([]interface{}); ok {
+		for _, keyword := range keywords {
+			if keyword, ok := keyword.(string); ok {
+				entry.Keywords = append(entry.Keywords, keyword)
+			}
+		}
+	}
+
+	return entry
+}
+
+// searchIndexPrefers reports whether version replaces the indexed version. The highest tag is indexed,
+// branches only when the package has no tag.
+func searchIndexPrefers(version, indexed string) bool {
+	indexedVersion, err := ParseVersion(indexed)
+	if indexed == "" || err != nil {
+		return true
+	}
+
+	parsed, err := ParseVersion(version)
+	if err != nil {
+		return false
+	}
+
+	return parsed.Compare(indexedVersion) >= 0
+}
+
+// updateSearchIndex stores the searchable fields of the given version when it is the highest version of
+// the package.
+func updateSearchIndex(tx *bolt.Tx, composerJson map[string]interface{}, version string) error {
+	entry := newSearchIndexEntry(composerJson)
+	entry.Version = version
+	bucket := tx.Bucket([]byte("packages"))
+	key := []byte("search--" + entry.Name)
+
+	if data := bucket.Get(key); data != nil {
+		var indexed SearchIndexEntry
+		if err := json.Unmarshal(data, &indexed); err == nil && !searchIndexPrefers(version, indexed.Version) {
+			return nil
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(key, data)
+}
+
+func removeSearchIndex(tx *bolt.Tx, packageName string) error {
+	return tx.Bucket([]byte("packages")).Delete([]byte("search--" + packageName))
+}
+
+// reindexPackage recreates the search entry of a package from its stored versions, e.g. after the indexed
+// version was deleted. The entry is removed when the package has no versions left.
+func reindexPackage(tx *bolt.Tx, packageName string) error {
+	if err := removeSearchIndex(tx, packageName); err != nil {
+		return err
+	}
+
+	var entries []map[string]interface{}
+	var versions []string
+
+	prefix := []byte("packages--" + packageName + "|")
+	c := tx.Bucket([]byte("packages")).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		composerJson := map[string]interface{}{}
+
+		if err := json.Unmarshal(v, &composerJson); err != nil {
+			return err
+		}
+
+		entries = append(entries, composerJson)
+		versions = append(versions, string(bytes.TrimPrefix(k, prefix)))
+	}
+
+	for i, composerJson := range entries {
+		if err := updateSearchIndex(tx, composerJson, versions[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuildSearchIndex recreates the search index from all stored versions, so databases created before the
+// index or its current revision existed become searchable. It only runs once per revision, the index is
+// kept up to date when versions are stored or deleted.
+func rebuildSearchIndex() error {
+	return app.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte("meta"))
+		if string(meta.Get([]byte("search_index_revision"))) == searchIndexRevision {
+			return nil
+		}
+
+		bucket := tx.Bucket([]byte("packages"))
+
+		prefix := []byte("search--")
+		var staleKeys [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			staleKeys = append(staleKeys, bytes.Clone(k))
+		}
+
+		for _, k := range staleKeys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		prefix = []byte("packages--")
+		var packageNames []string
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			packageName, _, _ := strings.Cut(string(bytes.TrimPrefix(k, prefix)), "|")
+
+			if len(packageNames) == 0 || packageNames[len(packageNames)-1] != packageName {
+				packageNames = append(packageNames, packageName)
+			}
+		}
+
+		for _, packageName := range packageNames {
+			if err := reindexPackage(tx, packageName); err != nil {
+				return err
+			}
+		}
+
+		return meta.Put([]byte("search_index_revision"), []byte(searchIndexRevision))
+	})
+}
+
+func (e SearchIndexEntry) matches(query []string, packageType string) bool {
+	if packageType != "" && e.Type != packageType {
+		return false
+	}
+
+	haystack := strings.ToLower(e.Name + " " + e.Description + " " + strings.Join(e.Keywords, " "))
+
+	for _, word := range query {
+		if !strings.Contains(haystack, word) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := authorizeRequest(w, r, scopeRead)
+
+	if user == nil {
+		return
+	}
+
+	query := strings.Fields(strings.ToLower(r.URL.Query().Get("q")))
+	packageType := r.URL.Query().Get("type")
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	results := make([]SearchResult, 0)
+
+	err := app.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("packages")).Cursor()
+
+		prefix := []byte("search--")
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var entry SearchIndexEntry
+
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+
+			if !user.HasAccessToPackage(entry.Name) || !entry.matches(query, packageType) {
+				continue
+			}
+
+			results = append(results, SearchResult{
+				Name:        entry.Name,
+				Description: entry.Description,
+				URL:         entry.Homepage,
+				Repository:  entry.Repository,
+				Abandoned:   entry.Abandoned,
+			})
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithContext(r.Context()).Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{"results": results, "total": len(results)})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
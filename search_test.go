@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func indexedSearchEntry(t *testing.T, packageName string) *SearchIndexEntry {
+	t.Helper()
+
+	var entry *SearchIndexEntry
+
+	err := app.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte("packages")).Get([]byte("search--" + packageName))
+		if data == nil {
+			return nil
+		}
+
+		entry = &SearchIndexEntry{}
+		return json.Unmarshal(data, entry)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return entry
+}
+
+func TestSearchIndexHighestVersion(t *testing.T) {
+	previousApp := app
+	t.Cleanup(func() { app = previousApp })
+
+	app = &App{}
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "packages.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+	app.db = db
+
+	stored := map[string]string{
+		"packages--acme/tool|2.0.0":    `{"name": "acme/tool", "description": "two"}`,
+		"packages--acme/tool|1.0.0":    `{"name": "acme/tool", "description": "one"}`,
+		"packages--acme/tool|dev-main": `{"name": "acme/tool", "description": "main"}`,
+		"packages--acme/dev|dev-main":  `{"name": "acme/dev", "description": "main"}`,
+		"search--acme/gone":            `{"name": "acme/gone"}`,
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucket([]byte("meta")); err != nil {
+			return err
+		}
+
+		bucket, err := tx.CreateBucket([]byte("packages"))
+		if err != nil {
+			return err
+		}
+
+		for key, value := range stored {
+			if err := bucket.Put([]byte(key), []byte(value)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rebuildSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry := indexedSearchEntry(t, "acme/tool"); entry == nil || entry.Version != "2.0.0" || entry.Description != "two" {
+		t.Errorf("expected the highest tag to be indexed, got %+v", entry)
+	}
+
+	if entry := indexedSearchEntry(t, "acme/dev"); entry == nil || entry.Version != "dev-main" {
+		t.Errorf("expected the branch of a package without tags to be indexed, got %+v", entry)
+	}
+
+	if entry := indexedSearchEntry(t, "acme/gone"); entry != nil {
+		t.Errorf("expected the entry of a package without versions to be removed, got %+v", entry)
+	}
+
+	update := func(version, description string) {
+		err := db.Update(func(tx *bolt.Tx) error {
+			return updateSearchIndex(tx, map[string]interface{}{"name": "acme/tool", "description": description}, version)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update("1.5.0", "one and a half")
+	update("dev-feature", "feature")
+
+	if entry := indexedSearchEntry(t, "acme/tool"); entry.Version != "2.0.0" {
+		t.Errorf("expected lower versions not to replace the entry, got %+v", entry)
+	}
+
+	update("2.1.0-RC1", "release candidate")
+
+	if entry := indexedSearchEntry(t, "acme/tool"); entry.Version != "2.1.0-RC1" || entry.Description != "release candidate" {
+		t.Errorf("expected a higher version to replace the entry, got %+v", entry)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("packages")).Put([]byte("search--acme/gone"), []byte(`{"name": "acme/gone"}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rebuildSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry := indexedSearchEntry(t, "acme/gone"); entry == nil {
+		t.Error("expected the index to be rebuilt only once")
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("packages")).Delete([]byte("packages--acme/tool|2.0.0")); err != nil {
+			return err
+		}
+
+		return reindexPackage(tx, "acme/tool")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry := indexedSearchEntry(t, "acme/tool"); entry == nil || entry.Version != "1.0.0" {
+		t.Errorf("expected the highest remaining version to be indexed, got %+v", entry)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+)
+
+const (
+	failedSecretTTL  = time.Minute
+	maxFailedSecrets = 10000
+)
+
+// verifiedSecrets caches successful hash verifications, bcrypt and argon2id are too slow to run on
+// every metadata request.
+var verifiedSecrets sync.Map
+
+// failedSecrets remembers failed hash verifications for failedSecretTTL, so repeating a wrong secret does not
+// run the slow hash again. It is cleared when it grows beyond maxFailedSecrets.
+var failedSecrets = struct {
+	sync.Mutex
+	entries map[string]time.Time
+}{entries: make(map[string]time.Time)}
+
+// slowHashChecks limits the concurrent bcrypt and argon2id verifications, an argon2id check allocates 64 MiB.
+var slowHashChecks = make(chan struct{}, runtime.NumCPU())
+
+// matchesSecret compares the provided secret in constant time against the configured plain secret,
+// or against the hash when one is configured.
+func matchesSecret(provided, plain, hash string) bool {
+	if hash == "" {
+		return plain != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(plain)) == 1
+	}
+
+	providedSum := sha256.Sum256([]byte(provided))
+	cacheKey := string(providedSum[:]) + hash
+
+	if _, ok := verifiedSecrets.Load(cacheKey); ok {
+		return true
+	}
+
+	if secretFailedRecently(cacheKey) {
+		return false
+	}
+
+	if !verifySecretHash(provided, hash) {
+		rememberFailedSecret(cacheKey)
+		return false
+	}
+
+	verifiedSecrets.Store(cacheKey, true)
+
+	return true
+}
+
+func verifySecretHash(provided, hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "sha256:"):
+		expected, err := hex.DecodeString(strings.TrimPrefix(hash, "sha256:"))
+		if err != nil {
+			return false
+		}
+
+		sum := sha256.Sum256([]byte(provided))
+
+		return subtle.ConstantTimeCompare(sum[:], expected) == 1
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		slowHashChecks <- struct{}{}
+		defer func() { <-slowHashChecks }()
+
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(provided)) == nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		slowHashChecks <- struct{}{}
+		defer func() { <-slowHashChecks }()
+
+		return verifyArgon2id(provided, hash)
+	}
+
+	return false
+}
+
+func secretFailedRecently(cacheKey string) bool {
+	failedSecrets.Lock()
+	defer failedSecrets.Unlock()
+
+	failedAt, ok := failedSecrets.entries[cacheKey]
+
+	return ok && time.Since(failedAt) < failedSecretTTL
+}
+
+func rememberFailedSecret(cacheKey string) {
+	failedSecrets.Lock()
+	defer failedSecrets.Unlock()
+
+	if len(failedSecrets.entries) >= maxFailedSecrets {
+		clear(failedSecrets.entries)
+	}
+
+	failedSecrets.entries[cacheKey] = time.Now()
+}
+
+// verifyArgon2id checks a hash in the PHC string format: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func verifyArgon2id(provided, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(provided), salt, time, memory, threads, uint32(len(expected)))
+
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+func hashSecret(secret, algorithm string) (string, error) {
+	switch algorithm {
+	case "sha256":
+		sum := sha256.Sum256([]byte(secret))
+
+		return "sha256:" + hex.EncodeToString(sum[:]), nil
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+
+		return string(hash), err
+	case "argon2id":
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(secret), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+		return fmt.Sprintf(
+			"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version,
+			argon2Memory,
+			argon2Time,
+			argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	}
+
+	return "", fmt.Errorf("unknown hash algorithm %s, use argon2id, bcrypt or sha256", algorithm)
+}
+
+func generateToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+// runGenerateToken implements the generate-token subcommand, it prints a new random token and its hash.
+func runGenerateToken(args []string) error {
+	flags := flag.NewFlagSet("generate-token", flag.ExitOnError)
+	algorithm := flags.String("algorithm", "argon2id", "hash algorithm: argon2id, bcrypt or sha256")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	hash, err := hashSecret(token, *algorithm)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("token: %s\n", token)
+	fmt.Printf("hash:  %s\n", hash)
+
+	return nil
+}
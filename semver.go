@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Stabilities in ascending order, a version without suffix is stable.
+const (
+	stabilityDev = iota
+	stabilityAlpha
+	stabilityBeta
+	stabilityRC
+	stabilityStable
+	stabilityPatch
+)
+
+var versionPattern = regexp.MustCompile(`^v?(\d+)(?:\.(\d+|[x*]))?(?:\.(\d+|[x*]))?(?:\.(\d+|[x*]))?(?:[.-]?(stable|beta|b|rc|alpha|a|patch|pl|p|dev)\.?(\d+)?)?$`)
+
+// Version is a normalized Composer version with four numeric parts.
+type Version struct {
+	Parts        [4]int
+	Stability    int
+	StabilityNum int
+}
+
+// VersionConstraint is a Composer constraint in disjunctive normal form: one of the groups has to match
+// completely.
+type VersionConstraint struct {
+	groups [][]versionComparison
+}
+
+type versionComparison struct {
+	operator string
+	version  Version
+}
+
+// ParseVersion normalizes versions like v1.2, 1.2.3.4 or 2.0.0-RC1. Branches (dev-*) are not versions.
+func ParseVersion(version string) (Version, error) {
+	v, precision, err := parseVersionPrefix(version)
+	if err != nil {
+		return v, err
+	}
+
+	if precision >= 0 {
+		return v, fmt.Errorf("version %q contains wildcards", version)
+	}
+
+	return v, nil
+}
+
+// parseVersionPrefix parses a version that may end with a wildcard and returns how many parts were given
+// before the wildcard, or -1 when there is none.
+func parseVersionPrefix(version string) (Version, int, error) {
+	var v Version
+
+	match := versionPattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(version)))
+	if match == nil {
+		return v, 0, fmt.Errorf("invalid version %q", version)
+	}
+
+	precision := 0
+	wildcard := false
+	for i := 0; i < 4; i++ {
+		part := match[i+1]
+		if part == "" {
+			break
+		}
+
+		if part == "x" || part == "*" {
+			wildcard = true
+			break
+		}
+
+		v.Parts[i], _ = strconv.Atoi(part)
+		precision++
+	}
+
+	v.Stability = stabilityStable
+	switch match[5] {
+	case "dev":
+		v.Stability = stabilityDev
+	case "alpha", "a":
+		v.Stability = stabilityAlpha
+	case "beta", "b":
+		v.Stability = stabilityBeta
+	case "rc":
+		v.Stability = stabilityRC
+	case "patch", "pl", "p":
+		v.Stability = stabilityPatch
+	}
+
+	v.StabilityNum, _ = strconv.Atoi(match[6])
+
+	if wildcard {
+		return v, precision, nil
+	}
+
+	return v, -1, nil
+}
+
+func (v Version) Compare(other Version) int {
+	for i := range v.Parts {
+		if v.Parts[i] != other.Parts[i] {
+			if v.Parts[i] < other.Parts[i] {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	if v.Stability != other.Stability {
+		if v.Stability < other.Stability {
+			return -1
+		}
+
+		return 1
+	}
+
+	if v.StabilityNum != other.StabilityNum {
+		if v.StabilityNum < other.StabilityNum {
+			return -1
+		}
+
+		return 1
+	}
+
+	return 0
+}
+
+// bump increases the part at the given index and resets all following parts, the result is the lowest
+// dev version of the next release, like Composer does for upper bounds.
+func (v Version) bump(index int) Version {
+	next := Version{Stability: stabilityDev}
+
+	for i := 0; i < index; i++ {
+		next.Parts[i] = v.Parts[i]
+	}
+
+	next.Parts[index] = v.Parts[index] + 1
+
+	return next
+}
+
+func (v Version) lowest() Version {
+	if v.Stability == stabilityStable && v.StabilityNum == 0 {
+		v.Stability = stabilityDev
+	}
+
+	return v
+}
+
+var (
+	constraintOrPattern       = regexp.MustCompile(`\s*\|\|?\s*`)
+	constraintOperatorSpacing = regexp.MustCompile(`([<>=!~^])\s+`)
+	constraintHyphenPattern   = regexp.MustCompile(`^(\S+)\s+-\s+(\S+)$`)
+	constraintAndPattern      = regexp.MustCompile(`\s*,\s*|\s+`)
+	constraintItemPattern     = regexp.MustCompile(`^(<>|!=|>=|<=|==|=|<|>|\^|~)?(.+)$`)
+	stabilityFlagPattern      = regexp.MustCompile(`@(stable|rc|beta|alpha|dev)$`)
+)
+
+// ParseVersionConstraint parses Composer constraints like ^2.0, ~1.2, 2.*, >=1.0 <3.0 || 4.0.0 and
+// 1.0 - 2.0.
+func ParseVersionConstraint(constraint string) (*VersionConstraint, error) {
+	parsed := &VersionConstraint{}
+
+	constraint = strings.TrimSpace(constraint)
+	if constraint == "" {
+		return nil, fmt.Errorf("empty version constraint")
+	}
+
+	for _, group := range constraintOrPattern.Split(constraint, -1) {
+		var comparisons []versionComparison
+
+		if hyphen := constraintHyphenPattern.FindStringSubmatch(group); hyphen != nil {
+			lower, err := parseConstraintItem(">=" + hyphen[1])
+			if err != nil {
+				return nil, err
+			}
+
+			upper, err := parseHyphenUpperBound(hyphen[2])
+			if err != nil {
+				return nil, err
+			}
+
+			parsed.groups = append(parsed.groups, append(lower, upper))
+			continue
+		}
+
+		group = constraintOperatorSpacing.ReplaceAllString(group, "$1")
+
+		for _, item := range constraintAndPattern.Split(group, -1) {
+			itemComparisons, err := parseConstraintItem(item)
+			if err != nil {
+				return nil, err
+			}
+
+			comparisons = append(comparisons, itemComparisons...)
+		}
+
+		parsed.groups = append(parsed.groups, comparisons)
+	}
+
+	return parsed, nil
+}
+
+func parseHyphenUpperBound(version string) (versionComparison, error) {
+	v, precision, err := parseVersionPrefix(version)
+	if err != nil {
+		return versionComparison{}, err
+	}
+
+	if precision < 0 {
+		precision = strings.Count(strings.Split(version, "-")[0], ".") + 1
+	}
+
+	// a partial upper bound includes the whole release line: 1.0 - 2.0 means <2.1
+	if precision < 3 {
+		return versionComparison{operator: "<", version: v.bump(precision - 1)}, nil
+	}
+
+	return versionComparison{operator: "<=", version: v}, nil
+}
+
+func parseConstraintItem(item string) ([]versionComparison, error) {
+	item = stabilityFlagPattern.ReplaceAllString(strings.TrimSpace(item), "")
+
+	if item == "*" || item == "x" {
+		return []versionComparison{{operator: ">=", version: Version{Stability: stabilityDev}}}, nil
+	}
+
+	match := constraintItemPattern.FindStringSubmatch(item)
+	if match == nil {
+		return nil, fmt.Errorf("invalid version constraint %q", item)
+	}
+
+	operator := match[1]
+	v, precision, err := parseVersionPrefix(match[2])
+	if err != nil {
+		return nil, err
+	}
+
+	given := precision
+	if given < 0 {
+		given = strings.Count(strings.Split(match[2], "-")[0], ".") + 1
+	}
+
+	switch operator {
+	case "^":
+		// the first non-zero part may not change, ^0.3 allows 0.3.* only
+		index := 0
+		for index < given-1 && index < 2 && v.Parts[index] == 0 {
+			index++
+		}
+
+		return []versionComparison{{operator: ">=", version: v.lowest()}, {operator: "<", version: v.bump(index)}}, nil
+	case "~":
+		// the last given part may increase, ~1.2 allows 1.*, ~1.2.3 allows 1.2.*
+		index := given - 2
+		if index < 0 {
+			index = 0
+		}
+
+		return []versionComparison{{operator: ">=", version: v.lowest()}, {operator: "<", version: v.bump(index)}}, nil
+	}
+
+	if precision >= 0 {
+		if precision == 0 {
+			return []versionComparison{{operator: ">=", version: Version{Stability: stabilityDev}}}, nil
+		}
+
+		// wildcards like 1.2.* cover the release line of the given parts
+		lower := v.lowest()
+		upper := v.bump(precision - 1)
+
+		switch operator {
+		case "", "=", "==":
+			return []versionComparison{{operator: ">=", version: lower}, {operator: "<", version: upper}}, nil
+		case ">=":
+			return []versionComparison{{operator: ">=", version: lower}}, nil
+		case ">":
+			return []versionComparison{{operator: ">=", version: upper}}, nil
+		case "<":
+			return []versionComparison{{operator: "<", version: lower}}, nil
+		case "<=":
+			return []versionComparison{{operator: "<", version: upper}}, nil
+		}
+
+		return nil, fmt.Errorf("operator %s cannot be used with wildcards in %q", operator, item)
+	}
+
+	switch operator {
+	case "", "=":
+		operator = "=="
+	case "<>":
+		operator = "!="
+	case "<", ">=":
+		// like Composer, <3.0 means <3.0.0.0-dev, so the pre-releases of 3.0 are excluded and the ones of
+		// >=2.0 included
+		v = v.lowest()
+	}
+
+	return []versionComparison{{operator: operator, version: v}}, nil
+}
+
+func (c *VersionConstraint) Matches(v Version) bool {
+	for _, group := range c.groups {
+		matched := true
+
+		for _, comparison := range group {
+			if !comparison.matches(v) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchesVersion checks a stored version string, branches never satisfy a constraint.
+func (c *VersionConstraint) MatchesVersion(version string) bool {
+	v, err := ParseVersion(version)
+	if err != nil {
+		return false
+	}
+
+	return c.Matches(v)
+}
+
+func (c versionComparison) matches(v Version) bool {
+	result := v.Compare(c.version)
+
+	switch c.operator {
+	case "==":
+		return result == 0
+	case "!=":
+		return result != 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	}
+
+	return false
+}
@@ -0,0 +1,190 @@
+package main
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    Version
+	}{
+		{"1.0.0", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityStable}},
+		{"1.2", Version{Parts: [4]int{1, 2, 0, 0}, Stability: stabilityStable}},
+		{"v1.2.3", Version{Parts: [4]int{1, 2, 3, 0}, Stability: stabilityStable}},
+		{"V1.2.3.4", Version{Parts: [4]int{1, 2, 3, 4}, Stability: stabilityStable}},
+		{"1.0.0-beta2", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityBeta, StabilityNum: 2}},
+		{"1.0.0-b2", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityBeta, StabilityNum: 2}},
+		{"1.0.0-RC1", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityRC, StabilityNum: 1}},
+		{"1.0.0RC1", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityRC, StabilityNum: 1}},
+		{"1.0.0-rc.1", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityRC, StabilityNum: 1}},
+		{"1.0.0-alpha3", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityAlpha, StabilityNum: 3}},
+		{"1.0.0-a3", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityAlpha, StabilityNum: 3}},
+		{"1.0.0-dev", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityDev}},
+		{"1.0.0-patch1", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityPatch, StabilityNum: 1}},
+		{"1.0.0-pl1", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityPatch, StabilityNum: 1}},
+		{"1.0.0-stable", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityStable}},
+		{" 1.0.0 ", Version{Parts: [4]int{1, 0, 0, 0}, Stability: stabilityStable}},
+	}
+
+	for _, test := range tests {
+		got, err := ParseVersion(test.version)
+		if err != nil {
+			t.Errorf("ParseVersion(%q) returned error: %s", test.version, err)
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("ParseVersion(%q) = %+v, want %+v", test.version, got, test.want)
+		}
+	}
+}
+
+func TestParseVersionInvalid(t *testing.T) {
+	for _, version := range []string{"", "dev-master", "master", "1.x", "1.*", "1.0.0-foo", "a.b.c", "1.0.0.0.0"} {
+		if _, err := ParseVersion(version); err == nil {
+			t.Errorf("ParseVersion(%q) did not return an error", version)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	// each version is lower than the next one
+	ordered := []string{
+		"1.0.0-dev",
+		"1.0.0-alpha1",
+		"1.0.0-alpha2",
+		"1.0.0-beta1",
+		"1.0.0-beta10",
+		"1.0.0-RC1",
+		"1.0.0",
+		"1.0.0-patch1",
+		"1.0.1",
+		"1.0.10",
+		"1.1.0",
+		"1.1.0.1",
+		"2.0.0",
+	}
+
+	for i := 0; i < len(ordered)-1; i++ {
+		lower, _ := ParseVersion(ordered[i])
+		higher, _ := ParseVersion(ordered[i+1])
+
+		if lower.Compare(higher) != -1 || higher.Compare(lower) != 1 {
+			t.Errorf("expected %s < %s", ordered[i], ordered[i+1])
+		}
+	}
+
+	a, _ := ParseVersion("v1.0")
+	b, _ := ParseVersion("1.0.0.0")
+	if a.Compare(b) != 0 {
+		t.Errorf("expected v1.0 == 1.0.0.0")
+	}
+}
+
+// The cases follow the constraint tests of Composer's semver library, the bounds in the comments are the
+// normalized constraints Composer generates.
+func TestVersionConstraintMatches(t *testing.T) {
+	tests := []struct {
+		constraint string
+		matches    []string
+		excludes   []string
+	}{
+		// >=1.2.3.0-dev <2.0.0.0-dev
+		{"^1.2.3", []string{"1.2.3", "1.2.4", "1.9.9", "1.2.3-patch1", "1.2.3-beta1"}, []string{"1.2.2", "1.2.2-patch1", "2.0.0", "2.0.0-beta1"}},
+		// >=1.2.0.0-dev <2.0.0.0-dev
+		{"^1.2", []string{"1.2.0", "1.3.0"}, []string{"1.1.9", "2.0.0"}},
+		// >=1.0.0.0-dev <2.0.0.0-dev
+		{"^1", []string{"1.0.0", "1.9.0"}, []string{"0.9.0", "2.0.0"}},
+		// >=0.3.0.0-dev <0.4.0.0-dev
+		{"^0.3", []string{"0.3.0", "0.3.9"}, []string{"0.2.9", "0.4.0", "1.0.0"}},
+		// >=0.0.3.0-dev <0.0.4.0-dev
+		{"^0.0.3", []string{"0.0.3", "0.0.3.1"}, []string{"0.0.2", "0.0.4", "0.1.0"}},
+		// >=0.0.0.0-dev <0.1.0.0-dev
+		{"^0.0", []string{"0.0.0", "0.0.9"}, []string{"0.1.0"}},
+		// >=0.0.0.0-dev <1.0.0.0-dev
+		{"^0", []string{"0.0.1", "0.9.0"}, []string{"1.0.0"}},
+		// >=1.2.3.0-beta2 <2.0.0.0-dev
+		{"^1.2.3-beta2", []string{"1.2.3-beta2", "1.2.3-RC1", "1.2.3"}, []string{"1.2.3-beta1", "2.0.0"}},
+		// >=1.2.0.0-dev <2.0.0.0-dev
+		{"~1.2", []string{"1.2.0", "1.9.9"}, []string{"1.1.0", "2.0.0"}},
+		// >=1.2.3.0-dev <1.3.0.0-dev
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.2.2", "1.3.0"}},
+		// >=1.0.0.0-dev <2.0.0.0-dev
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		// >=1.2.0.0-beta <2.0.0.0-dev
+		{"~1.2-beta", []string{"1.2.0-beta1", "1.5.0"}, []string{"1.2.0-alpha1", "2.0.0"}},
+		// >=1.2.0.0-dev <1.3.0.0-dev
+		{"1.2.*", []string{"1.2.0", "1.2.9"}, []string{"1.1.9", "1.3.0"}},
+		{"1.2.x", []string{"1.2.0", "1.2.9"}, []string{"1.3.0"}},
+		// >=1.0.0.0-dev <2.0.0.0-dev
+		{"1.*", []string{"1.0.0", "1.99.0"}, []string{"0.9.0", "2.0.0"}},
+		{"*", []string{"0.0.1", "1.0.0", "99.0.0-beta1"}, nil},
+		{">=1.2.*", []string{"1.2.0", "2.0.0"}, []string{"1.1.9"}},
+		{"<1.2.*", []string{"1.1.9"}, []string{"1.2.0"}},
+		// >=1.0.0.0-dev <2.1.0.0-dev
+		{"1.0 - 2.0", []string{"1.0.0", "2.0.5"}, []string{"0.9.9", "2.1.0"}},
+		// >=1.2.3.0-dev <=2.3.4.0
+		{"1.2.3 - 2.3.4", []string{"1.2.3", "2.3.4"}, []string{"1.2.2", "2.3.5"}},
+		{">=1.0 <2.0 || ^3", []string{"1.0.0", "1.9.9", "3.0.0", "3.5.0"}, []string{"2.0.0", "2.5.0", "4.0.0", "0.9.0"}},
+		{">=1.0,<2.0", []string{"1.5.0"}, []string{"2.0.0"}},
+		{">= 1.0 < 2.0", []string{"1.5.0"}, []string{"2.0.0"}},
+		{"^1.0 | ^3.0", []string{"1.1.0", "3.1.0"}, []string{"2.0.0"}},
+		{"1.0.0", []string{"1.0.0", "v1.0.0", "1.0.0.0"}, []string{"1.0.1", "1.0.0-beta1"}},
+		{"==1.0.0", []string{"1.0.0"}, []string{"1.0.1"}},
+		{"v1.0.0", []string{"1.0.0"}, []string{"1.0.1"}},
+		{"!=1.0.0", []string{"1.0.1", "0.9.0"}, []string{"1.0.0"}},
+		{"<>1.0.0", []string{"1.0.1"}, []string{"1.0.0"}},
+		{">1.0.0", []string{"1.0.1", "1.0.0-patch1"}, []string{"1.0.0", "0.9.0"}},
+		// <1.0.0.0-dev
+		{"<1.0.0", []string{"0.9.0", "0.9.9-RC1"}, []string{"1.0.0", "1.0.0-RC1", "1.0.0-dev"}},
+		// >=2.0.0.0-dev <3.0.0.0-dev
+		{">=2.0 <3.0", []string{"2.0.0-RC1", "2.0.0-dev", "2.0.0", "2.9.9"}, []string{"1.9.9", "3.0.0-RC1", "3.0.0-dev", "3.0.0"}},
+		{">=2.0", []string{"2.0.0-alpha1", "2.0.0"}, []string{"1.9.9"}},
+		// <2.0.0.0-beta, an explicit stability is kept
+		{"<2.0-beta", []string{"2.0.0-alpha1", "1.9.9"}, []string{"2.0.0-beta1", "2.0.0"}},
+		{">=2.0-RC1", []string{"2.0.0-RC1", "2.0.0"}, []string{"2.0.0-beta1"}},
+		{"<=1.0.0", []string{"1.0.0"}, []string{"1.0.1"}},
+		{">=1.0.0@dev", []string{"1.0.0", "2.0.0"}, []string{"0.9.0"}},
+		{"^2.0@beta", []string{"2.0.0", "2.1.0-beta1"}, []string{"3.0.0"}},
+	}
+
+	for _, test := range tests {
+		constraint, err := ParseVersionConstraint(test.constraint)
+		if err != nil {
+			t.Errorf("ParseVersionConstraint(%q) returned error: %s", test.constraint, err)
+			continue
+		}
+
+		for _, version := range test.matches {
+			if !constraint.MatchesVersion(version) {
+				t.Errorf("%q should match %s", test.constraint, version)
+			}
+		}
+
+		for _, version := range test.excludes {
+			if constraint.MatchesVersion(version) {
+				t.Errorf("%q should not match %s", test.constraint, version)
+			}
+		}
+	}
+}
+
+func TestVersionConstraintBranches(t *testing.T) {
+	constraint, err := ParseVersionConstraint("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"dev-master", "dev-feature/foo"} {
+		if constraint.MatchesVersion(version) {
+			t.Errorf("%q should not match the branch %s", "*", version)
+		}
+	}
+}
+
+func TestParseVersionConstraintInvalid(t *testing.T) {
+	for _, constraint := range []string{"", "foo", "^", ">=", "~x", "!=1.*", "1.0 ||", ">=1.0 <"} {
+		if _, err := ParseVersionConstraint(constraint); err == nil {
+			t.Errorf("ParseVersionConstraint(%q) did not return an error", constraint)
+		}
+	}
+}
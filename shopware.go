@@ -8,8 +8,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
-	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
 )
@@ -26,11 +26,21 @@ func (s ShopwareProvider) GetConfig() ConfigProvider {
 	return s.provider
 }
 
-func (s ShopwareProvider) UpdateAll() error {
-	return db.Batch(func(tx *bolt.Tx) error {
+func (s ShopwareProvider) UpdateAll(ctx context.Context) error {
+	return tracedBatch(ctx, "shopware packages", func(tx *bolt.Tx) error {
 		for _, project := range s.provider.Projects {
-			if err := s.updatePackages(tx, context.Background(), project.Name); err != nil {
-				log.Errorf("cannot update all packages %s", err)
+			// a cancelled sync is rolled back instead of storing versions without their dists
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			// the project name is the token of the shop, only its fingerprint is used as label
+			err := observeSync(ctx, s.provider.Name, secretFingerprint(project.Name), func(ctx context.Context) error {
+				return s.updatePackages(tx, ctx, project.Name)
+			})
+
+			if err != nil {
+				log.WithContext(ctx).WithFields(log.Fields{"provider": s.provider.Name, "project": secretFingerprint(project.Name)}).WithError(err).Error("cannot update all packages")
 			}
 		}
 
@@ -42,15 +52,12 @@ func (ShopwareProvider) Webhook(request *http.Request) error {
 	return nil
 }
 
-func (s ShopwareProvider) RegisterCustomHTTPHandlers(router *httprouter.Router) {
-}
-
 func (s ShopwareProvider) updatePackages(tx *bolt.Tx, ctx context.Context, token string) error {
 	r, _ := http.NewRequestWithContext(ctx, "GET", "https://packages.shopware.com/packages.json", nil)
 
 	r.Header.Set("Authorization", "Bearer "+token)
 
-	client := &http.Client{}
+	client := tracedHTTPClient(&http.Client{})
 	resp, err := client.Do(r)
 
 	if err != nil {
@@ -73,40 +80,56 @@ func (s ShopwareProvider) updatePackages(tx *bolt.Tx, ctx context.Context, token
 
 	for name, pkg := range response.Packages {
 		for version, info := range pkg {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			logger := log.WithContext(ctx).WithFields(log.Fields{"provider": s.provider.Name, "package": name, "version": version})
 			dist := info["dist"].(map[string]interface{})
 
-			if err := s.storeZip(ctx, name, version, dist["url"].(string), token); err != nil {
-				log.Errorf("cannot download remote package (%s in version %s): %s", name, version, err)
+			zipPath, err := s.storeZip(ctx, name, version, dist["url"].(string), token)
+			if err != nil {
+				logger.WithError(err).Error("cannot download dist")
 			}
 
-			link := fmt.Sprintf("%s/custom/%s/%s/file.zip", config.URL, name, version)
+			link := fmt.Sprintf("%s/custom/%s/%s/file.zip", app.Config().URL, name, version)
+
+			if err := addOrUpdateVersionDirect(tx, info, link, version, name+version, s.provider.Name, time.Time{}); err != nil {
+				logger.WithError(err).Error("cannot update version")
+			}
 
-			if err := addOrUpdateVersionDirect(tx, info, link, version, name+version); err != nil {
-				log.Errorf("cannot update version %s:%s\n", name, version)
+			if zipPath != "" {
+				if err := setDistPath(tx, name, version, zipPath); err != nil {
+					logger.WithError(err).Error("cannot store dist path")
+				}
 			}
 
-			log.Infof("updated package %s in version %s", name, version)
+			logger.Info("updated version")
 		}
 	}
 
 	return nil
 }
 
-func (s ShopwareProvider) storeZip(ctx context.Context, name string, version string, url, token string) error {
-	zipPath := getZipPath(name, version)
+func (s ShopwareProvider) storeZip(ctx context.Context, name string, version string, url, token string) (string, error) {
+	zipPath, err := getZipPath(name, version)
+	if err != nil {
+		return "", err
+	}
+
 	zipFolder := filepath.Dir(zipPath)
 
 	if _, err := os.Stat(zipPath); err == nil {
-		return nil
+		return zipPath, nil
 	}
 
 	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	r.Header.Set("Authorization", "Bearer "+token)
 
-	resp, err := http.DefaultClient.Do(r)
+	resp, err := tracedHTTPClient(http.DefaultClient).Do(r)
 
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	defer resp.Body.Close()
@@ -114,16 +137,20 @@ func (s ShopwareProvider) storeZip(ctx context.Context, name string, version str
 	body, err := ioutil.ReadAll(resp.Body)
 
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if _, err := os.Stat(zipFolder); os.IsNotExist(err) {
 		if err := os.MkdirAll(zipFolder, os.ModePerm); err != nil {
-			return err
+			return "", err
 		}
 	}
 
-	return ioutil.WriteFile(zipPath, body, os.ModePerm)
+	if err := ioutil.WriteFile(zipPath, body, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	return zipPath, nil
 }
 
 type ComposerResponse struct {
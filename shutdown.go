@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultShutdownTimeout = 30
+
+// runningSyncs tracks the provider syncs, so the database is only closed after they finished. Once stopped,
+// no new syncs are started and idle is closed when the last running sync ended.
+var runningSyncs = struct {
+	sync.Mutex
+	running int
+	stopped bool
+	idle    chan struct{}
+}{}
+
+func beginSync() bool {
+	runningSyncs.Lock()
+	defer runningSyncs.Unlock()
+
+	if runningSyncs.stopped {
+		return false
+	}
+
+	runningSyncs.running++
+
+	return true
+}
+
+func endSync() {
+	runningSyncs.Lock()
+	defer runningSyncs.Unlock()
+
+	runningSyncs.running--
+
+	if runningSyncs.running == 0 && runningSyncs.idle != nil {
+		close(runningSyncs.idle)
+		runningSyncs.idle = nil
+	}
+}
+
+// waitForSyncs prevents new syncs and waits until the running ones returned or the context is done.
+func waitForSyncs(ctx context.Context) error {
+	runningSyncs.Lock()
+	runningSyncs.stopped = true
+
+	if runningSyncs.running == 0 {
+		runningSyncs.Unlock()
+		return nil
+	}
+
+	idle := make(chan struct{})
+	runningSyncs.idle = idle
+	runningSyncs.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown drains the HTTP servers and the provider syncs within the shutdown_timeout, the syncs have already
+// been cancelled by the root context. The database is closed last and stays open when work did not drain,
+// bbolt discards the unfinished transactions when the process exits.
+func shutdown(servers []*http.Server, scheduler gocron.Scheduler, shutdownTracing func(context.Context) error) error {
+	timeout := time.Duration(app.Config().ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.WithField("timeout", timeout.String()).Info("shutting down")
+
+	var errs []error
+	drained := true
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("server %s: %w", server.Addr, err))
+			drained = false
+		}
+	}
+
+	if err := scheduler.Shutdown(); err != nil {
+		errs = append(errs, fmt.Errorf("scheduler: %w", err))
+	}
+
+	if err := waitForSyncs(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("provider syncs: %w", err))
+		drained = false
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("tracing: %w", err))
+	}
+
+	if err := closeAuditLog(); err != nil {
+		errs = append(errs, fmt.Errorf("audit log: %w", err))
+	}
+
+	if !drained {
+		log.Warn("requests or provider syncs did not finish in time, the database is not closed")
+		return errors.Join(errs...)
+	}
+
+	if err := app.db.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("database: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,37 +12,34 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func registerSignalHandlers() {
-	handlePackageReload()
+func registerSignalHandlers(ctx context.Context) {
+	handlePackageReload(ctx)
 	handleConfigReload()
 }
 
 func handleConfigReload() {
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGUSR1)
 
 	go func() {
 		for range sigs {
-			log.Infof("Received signal, reloading config")
-			newConfig, err := LoadConfig()
-			if err != nil {
-				log.Errorf("Failed to reload config: %s", err)
-				continue
-			}
+			log.Info("received signal, reloading config")
 
-			config = newConfig
+			if _, err := app.reload(); err != nil {
+				log.WithError(err).Error("cannot reload config")
+			}
 		}
 	}()
 }
 
-func handlePackageReload() {
-	sigs := make(chan os.Signal)
+func handlePackageReload(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGUSR2)
 
 	go func() {
 		for range sigs {
-			log.Infof("Received signal, updating all packages")
-			updateAll(true)
+			log.Info("received signal, updating all packages")
+			updateAll(ctx, true)
 		}
 	}()
 }
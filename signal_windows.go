@@ -1,4 +1,6 @@
 package main
 
-func registerSignalHandlers() {
+import "context"
+
+func registerSignalHandlers(ctx context.Context) {
 }
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	statisticInstall  = "installs"
+	statisticDownload = "downloads"
+)
+
+var statisticDimensions = []string{"day", "package", "version", "identity"}
+
+// DownloadStatistic counts the installs reported by Composer and the dists served by this registry. Fields
+// that were not grouped by are empty.
+type DownloadStatistic struct {
+	Day       string `json:"day,omitempty"`
+	Package   string `json:"package,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Identity  string `json:"identity,omitempty"`
+	Installs  int64  `json:"installs"`
+	Downloads int64  `json:"downloads"`
+}
+
+type statisticCounters struct {
+	Installs  int64 `json:"installs"`
+	Downloads int64 `json:"downloads"`
+}
+
+// statisticKey orders the counters by day, the identity comes last as it is the only part that may
+// contain the separator.
+func statisticKey(day, packageName, version, identity string) []byte {
+	return []byte("stats--" + day + "|" + packageName + "|" + version + "|" + identity)
+}
+
+func recordStatistic(kind, packageName, version, identity string) error {
+	key := statisticKey(time.Now().UTC().Format(time.DateOnly), packageName, version, identity)
+
+	return app.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("stats"))
+
+		var counters statisticCounters
+		if data := bucket.Get(key); data != nil {
+			if err := json.Unmarshal(data, &counters); err != nil {
+				return err
+			}
+		}
+
+		if kind == statisticInstall {
+			counters.Installs++
+		} else {
+			counters.Downloads++
+		}
+
+		data, err := json.Marshal(counters)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(key, data)
+	})
+}
+
+// storedVersion maps the normalized version Composer reports, like 1.2.0.0, to the stored version.
+func storedVersion(tx *bolt.Tx, packageName, version string) (string, []byte) {
+	bucket := tx.Bucket([]byte("packages"))
+
+	if data := bucket.Get([]byte("packages--" + packageName + "|" + version)); data != nil {
+		return version, data
+	}
+
+	reported, err := ParseVersion(version)
+	if err != nil {
+		return "", nil
+	}
+
+	prefix := []byte("packages--" + packageName + "|")
+	c := bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		stored := strings.TrimPrefix(string(k), string(prefix))
+
+		if parsed, err := ParseVersion(stored); err == nil && parsed.Compare(reported) == 0 {
+			return stored, v
+		}
+	}
+
+	return "", nil
+}
+
+// notifyBatchHandler accepts the install notifications Composer sends to the notify-batch URL. Packages
+// the user cannot access are ignored.
+func notifyBatchHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := authorizeRequest(w, r, scopeRead)
+
+	if user == nil {
+		return
+	}
+
+	var notification struct {
+		Downloads []struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"downloads"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	for _, download := range notification.Downloads {
+		packageName := strings.ToLower(download.Name)
+
+		if !user.HasAccessToPackage(packageName) {
+			continue
+		}
+
+		var version string
+		composerJson := map[string]interface{}{}
+
+		err := app.db.View(func(tx *bolt.Tx) error {
+			var data []byte
+			if version, data = storedVersion(tx, packageName, download.Version); data == nil {
+				return nil
+			}
+
+			return json.Unmarshal(data, &composerJson)
+		})
+
+		if err != nil {
+			log.WithContext(r.Context()).Error(err)
+			continue
+		}
+
+		if version == "" || !user.HasAccessToVersion(packageName, version, versionReleaseTime(composerJson)) {
+			continue
+		}
+
+		if err := recordStatistic(statisticInstall, packageName, version, user.Identity()); err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"package": packageName, "version": version}).WithError(err).Error("cannot record install")
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+func registerStatisticsHandlers(router *Router) {
+	router.GET("/admin/stats", audited("admin", throttledAuth(statisticsHandler)))
+}
+
+// statisticsHandler sums the counters grouped by the dimensions given in group_by, by default per package,
+// version and day. The since and until days are inclusive, format=csv exports the rows as CSV.
+func statisticsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !validateAdminRequest(r) {
+		unauthorized(w)
+		return
+	}
+
+	query := r.URL.Query()
+
+	groupBy := map[string]bool{"day": true, "package": true, "version": true}
+	if value := query.Get("group_by"); value != "" {
+		groupBy = map[string]bool{}
+
+		for _, dimension := range strings.Split(value, ",") {
+			if !slices.Contains(statisticDimensions, dimension) {
+				http.Error(w, fmt.Sprintf("invalid group_by %q, expected %s", dimension, strings.Join(statisticDimensions, ",")), http.StatusBadRequest)
+				return
+			}
+
+			groupBy[dimension] = true
+		}
+	}
+
+	for _, name := range []string{"since", "until"} {
+		if value := query.Get(name); value != "" {
+			if _, err := time.Parse(time.DateOnly, value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s, expected YYYY-MM-DD", name), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	since, until := query.Get("since"), query.Get("until")
+	rows := make(map[string]*DownloadStatistic)
+
+	err := app.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("stats")).Cursor()
+
+		prefix := []byte("stats--")
+		for k, v := c.Seek([]byte("stats--" + since)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			parts := strings.SplitN(strings.TrimPrefix(string(k), "stats--"), "|", 4)
+			if len(parts) != 4 {
+				continue
+			}
+
+			row := DownloadStatistic{Day: parts[0], Package: parts[1], Version: parts[2], Identity: parts[3]}
+
+			if until != "" && row.Day > until {
+				break
+			}
+
+			if !row.matches(query) {
+				continue
+			}
+
+			var counters statisticCounters
+			if err := json.Unmarshal(v, &counters); err != nil {
+				return err
+			}
+
+			row.group(groupBy)
+
+			key := row.Day + "|" + row.Package + "|" + row.Version + "|" + row.Identity
+			if _, ok := rows[key]; !ok {
+				rows[key] = &row
+			}
+
+			rows[key].Installs += counters.Installs
+			rows[key].Downloads += counters.Downloads
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithContext(r.Context()).Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	statistics := make([]DownloadStatistic, 0, len(rows))
+	for _, row := range rows {
+		statistics = append(statistics, *row)
+	}
+
+	sort.Slice(statistics, func(i, j int) bool {
+		a, b := statistics[i], statistics[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+
+		return a.Identity < b.Identity
+	})
+
+	if query.Get("format") == "csv" {
+		writeStatisticsCSV(w, statistics, groupBy)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": statistics})
+}
+
+func (s DownloadStatistic) matches(query map[string][]string) bool {
+	filters := map[string]string{"package": s.Package, "version": s.Version, "identity": s.Identity}
+
+	for name, value := range filters {
+		if values, ok := query[name]; ok && values[0] != "" && values[0] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *DownloadStatistic) group(groupBy map[string]bool) {
+	if !groupBy["day"] {
+		s.Day = ""
+	}
+
+	if !groupBy["package"] {
+		s.Package = ""
+	}
+
+	if !groupBy["version"] {
+		s.Version = ""
+	}
+
+	if !groupBy["identity"] {
+		s.Identity = ""
+	}
+}
+
+func writeStatisticsCSV(w http.ResponseWriter, statistics []DownloadStatistic, groupBy map[string]bool) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="statistics.csv"`)
+
+	var header []string
+	for _, dimension := range statisticDimensions {
+		if groupBy[dimension] {
+			header = append(header, dimension)
+		}
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write(append(header, statisticInstall, statisticDownload))
+
+	for _, row := range statistics {
+		values := map[string]string{"day": row.Day, "package": row.Package, "version": row.Version, "identity": row.Identity}
+
+		var record []string
+		for _, dimension := range header {
+			record = append(record, values[dimension])
+		}
+
+		writer.Write(append(record, strconv.FormatInt(row.Installs, 10), strconv.FormatInt(row.Downloads, 10)))
+	}
+
+	writer.Flush()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ProviderStatus describes the last sync of a provider, the times are nil until a sync started.
+type ProviderStatus struct {
+	Name          string     `json:"name"`
+	Type          string     `json:"type"`
+	Syncing       bool       `json:"syncing"`
+	LastSyncStart *time.Time `json:"last_sync_start"`
+	LastSyncEnd   *time.Time `json:"last_sync_end"`
+	LastError     string     `json:"last_error,omitempty"`
+	Versions      int        `json:"versions"`
+	NextRun       *time.Time `json:"next_run,omitempty"`
+
+	projectErrors []error
+}
+
+var providerStatuses = struct {
+	sync.Mutex
+	statuses map[string]*ProviderStatus
+}{statuses: make(map[string]*ProviderStatus)}
+
+// initialSyncDone is set when the fetch_all_on_start sync has finished, the registry is not ready before.
+var initialSyncDone atomic.Bool
+
+func providerStatus(name string) *ProviderStatus {
+	status, ok := providerStatuses.statuses[name]
+	if !ok {
+		status = &ProviderStatus{Name: name}
+		providerStatuses.statuses[name] = status
+	}
+
+	return status
+}
+
+// syncProvider updates all packages of the provider and records the result in its status. Syncs of a
+// provider do not overlap, errSyncRunning is returned while one is running. No sync is started once the
+// registry is shutting down.
+func syncProvider(ctx context.Context, name string) (err error) {
+	if !beginSync() {
+		return context.Canceled
+	}
+
+	defer endSync()
+
+	provider, ok := app.Provider(name)
+	if !ok {
+		return fmt.Errorf("provider %s is not configured", name)
+	}
+
+	// a cron job can fire while a sync triggered by a signal or the initial sync is still running
+	lock := app.syncLock(name)
+	if !lock.TryLock() {
+		return errSyncRunning
+	}
+
+	defer lock.Unlock()
+
+	// webhooks received during the sync are applied after it
+	queue := app.webhookQueue(name)
+	queue.hold()
+	defer queue.release(ctx, name)
+
+	ctx, span := startProviderSpan(ctx, "sync "+name, name, "")
+	defer func() { endSpan(span, err) }()
+
+	providerStatuses.Lock()
+	status := providerStatus(name)
+	start := time.Now()
+	status.Syncing = true
+	status.LastSyncStart = &start
+	status.projectErrors = nil
+	providerStatuses.Unlock()
+
+	err = provider.UpdateAll(ctx)
+
+	providerStatuses.Lock()
+	defer providerStatuses.Unlock()
+
+	end := time.Now()
+	status.Syncing = false
+	status.LastSyncEnd = &end
+	status.LastError = ""
+
+	// some providers only log failing projects and continue with the next one
+	if len(status.projectErrors) > 0 {
+		err = errors.Join(status.projectErrors...)
+	}
+
+	if err != nil {
+		status.LastError = err.Error()
+	}
+
+	return err
+}
+
+// forgetProviderStatus removes the status of a provider that was removed from the config.
+func forgetProviderStatus(name string) {
+	providerStatuses.Lock()
+	defer providerStatuses.Unlock()
+
+	delete(providerStatuses.statuses, name)
+}
+
+// recordProjectError remembers the error of a project for the status of the running sync.
+func recordProjectError(name string, err error) {
+	providerStatuses.Lock()
+	defer providerStatuses.Unlock()
+
+	status := providerStatus(name)
+	status.projectErrors = append(status.projectErrors, err)
+}
+
+func registerStatusHandlers(router *Router) {
+	router.GET("/healthz", healthzHandler)
+	router.GET("/readyz", readyzHandler)
+	router.GET("/status", audited("admin", throttledAuth(statusHandler)))
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok"))
+}
+
+// readyzHandler reports ready once the database answers and the initial sync has finished.
+func readyzHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if app.db == nil {
+		http.Error(w, "database is not open", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := app.db.View(func(tx *bolt.Tx) error { return nil }); err != nil {
+		http.Error(w, "database is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !initialSyncDone.Load() {
+		http.Error(w, "initial sync is running", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok"))
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	state := app.current()
+
+	if !validateAdminRequest(r) {
+		unauthorized(w)
+		return
+	}
+
+	versions := make(map[string]int)
+
+	err := app.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte("packages--")
+		c := tx.Bucket([]byte("packages")).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			packageName, _, _ := strings.Cut(string(k[len(prefix):]), "|")
+
+			if provider, ok := packageProviders.Load(packageName); ok {
+				versions[provider.(string)]++
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithContext(r.Context()).Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	statuses := make([]ProviderStatus, 0, len(state.config.Providers))
+
+	providerStatuses.Lock()
+	for _, provider := range state.config.Providers {
+		status := *providerStatus(provider.Name)
+		status.Type = provider.Type
+		status.Versions = versions[provider.Name]
+
+		if job, ok := state.cronJobs[provider.Name]; ok {
+			if next, err := job.NextRun(); err == nil {
+				status.NextRun = &next
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+	providerStatuses.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ready":     initialSyncDone.Load(),
+		"providers": statuses,
+	})
+}
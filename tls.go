@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Certificate files are checked for changes in this interval, so renewed certificates are used without a
+// restart.
+const certificateReloadInterval = 10 * time.Second
+
+var clientCertificateTypes = []string{"cn", "subject", "dns", "email", "uri"}
+
+type certificateReloader struct {
+	sync.RWMutex
+	config      ConfigTLS
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	modTimes    map[string]time.Time
+}
+
+// newTLSConfig loads the configured certificate and client CA and reloads them when the files change.
+func newTLSConfig(config ConfigTLS) (*tls.Config, error) {
+	reloader := &certificateReloader{config: config}
+
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	go reloader.watch()
+
+	clientAuth := tls.NoClientCert
+	if config.ClientCAFile != "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+
+		if config.RequireClientCertificate {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		// a config per connection picks up a reloaded client CA
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			reloader.RLock()
+			defer reloader.RUnlock()
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   []string{"h2", "http/1.1"},
+				Certificates: []tls.Certificate{*reloader.certificate},
+				ClientAuth:   clientAuth,
+				ClientCAs:    reloader.clientCAs,
+			}, nil
+		},
+	}, nil
+}
+
+func (c *certificateReloader) files() []string {
+	files := []string{c.config.CertFile, c.config.KeyFile}
+	if c.config.ClientCAFile != "" {
+		files = append(files, c.config.ClientCAFile)
+	}
+
+	return files
+}
+
+func (c *certificateReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range c.files() {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		modTimes[file] = stat.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if c.config.ClientCAFile != "" {
+		data, err := os.ReadFile(c.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s contains no certificates", c.config.ClientCAFile)
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.certificate = &certificate
+	c.clientCAs = clientCAs
+	c.modTimes = modTimes
+
+	return nil
+}
+
+func (c *certificateReloader) changed() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, file := range c.files() {
+		stat, err := os.Stat(file)
+		if err == nil && !stat.ModTime().Equal(c.modTimes[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch keeps serving the previous certificate when the new files cannot be loaded, e.g. while the
+// certificate is written but the key not yet.
+func (c *certificateReloader) watch() {
+	for range time.Tick(certificateReloadInterval) {
+		if !c.changed() {
+			continue
+		}
+
+		if err := c.load(); err != nil {
+			log.WithField("cert_file", c.config.CertFile).WithError(err).Error("tls: cannot reload certificate")
+			continue
+		}
+
+		log.WithField("cert_file", c.config.CertFile).Info("tls: reloaded certificate")
+	}
+}
+
+func validateClientCertificates(values []string) error {
+	for _, value := range values {
+		certificateType, name, ok := strings.Cut(value, ":")
+		if !ok || name == "" || !slices.Contains(clientCertificateTypes, certificateType) {
+			return fmt.Errorf("invalid client certificate %q, expected one of %s followed by :<value>", value, strings.Join(clientCertificateTypes, ", "))
+		}
+	}
+
+	return nil
+}
+
+// MatchesCertificate checks the client_certificates of the user against the subject and the SANs of a
+// verified client certificate.
+func (c ConfigUser) MatchesCertificate(certificate *x509.Certificate) bool {
+	for _, value := range c.ClientCertificates {
+		certificateType, name, _ := strings.Cut(value, ":")
+
+		switch certificateType {
+		case "cn":
+			if certificate.Subject.CommonName == name {
+				return true
+			}
+		case "subject":
+			if certificate.Subject.String() == name {
+				return true
+			}
+		case "dns":
+			if slices.Contains(certificate.DNSNames, name) {
+				return true
+			}
+		case "email":
+			if slices.Contains(certificate.EmailAddresses, name) {
+				return true
+			}
+		case "uri":
+			for _, uri := range certificate.URIs {
+				if uri.String() == name {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The last used timestamp is only written once per interval, to not turn every request into a write transaction.
+const tokenLastUsedInterval = time.Minute
+
+// tokenCount caches whether the database has tokens, -1 means it has to be read again. It is reset when a
+// token is created.
+var tokenCount = struct {
+	sync.Mutex
+	count int
+}{count: -1}
+
+// tokenUsers caches the user of a token ID with compiled rules and networks.
+var tokenUsers sync.Map
+
+type DatabaseToken struct {
+	ID         string           `json:"id"`
+	Name       string           `json:"name"`
+	TokenHash  string           `json:"token_hash"`
+	CreatedAt  time.Time        `json:"created_at"`
+	ExpiresAt  *time.Time       `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time       `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time       `json:"revoked_at,omitempty"`
+	Rules      []ConfigUserRule `json:"rules"`
+	Scopes     []string         `json:"scopes,omitempty"`
+	AllowedIPs []string         `json:"allowed_ips,omitempty"`
+}
+
+type DatabaseTokenRequest struct {
+	Name       string           `json:"name"`
+	ExpiresAt  *time.Time       `json:"expires_at"`
+	Rules      []ConfigUserRule `json:"rules"`
+	Scopes     []string         `json:"scopes"`
+	AllowedIPs []string         `json:"allowed_ips"`
+}
+
+func (t DatabaseToken) IsActive(now time.Time) bool {
+	if t.RevokedAt != nil {
+		return false
+	}
+
+	return t.ExpiresAt == nil || now.Before(*t.ExpiresAt)
+}
+
+func (t DatabaseToken) User() *ConfigUser {
+	if cached, ok := tokenUsers.Load(t.ID); ok {
+		user := *cached.(*ConfigUser)
+		return &user
+	}
+
+	rules := t.Rules
+	if rules == nil {
+		rules = make([]ConfigUserRule, 0)
+	}
+
+	// rules and networks are validated on creation, this only precompiles them
+	compileRules(rules)
+	networks, _ := parseNetworks(t.AllowedIPs)
+
+	user := &ConfigUser{Username: t.Name, Rules: rules, Scopes: t.Scopes, AllowedIPs: t.AllowedIPs, identity: "token:" + t.ID, allowedNetworks: networks}
+	tokenUsers.Store(t.ID, user)
+
+	copied := *user
+
+	return &copied
+}
+
+func databaseTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// hasDatabaseTokens reports whether tokens were ever created, revoked tokens keep the registry closed.
+func hasDatabaseTokens() bool {
+	tokenCount.Lock()
+	defer tokenCount.Unlock()
+
+	if tokenCount.count >= 0 {
+		return tokenCount.count > 0
+	}
+
+	err := app.db.View(func(tx *bolt.Tx) error {
+		count := 0
+
+		c := tx.Bucket([]byte("tokens")).Cursor()
+		prefix := []byte("token--")
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			count++
+		}
+
+		tokenCount.count = count
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithError(err).Error("cannot count tokens")
+
+		// an unreadable database must not open the registry
+		return true
+	}
+
+	return tokenCount.count > 0
+}
+
+func forgetTokenCount() {
+	tokenCount.Lock()
+	tokenCount.count = -1
+	tokenCount.Unlock()
+}
+
+func getDatabaseToken(tx *bolt.Tx, id string) (*DatabaseToken, error) {
+	data := tx.Bucket([]byte("tokens")).Get([]byte("token--" + id))
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var token DatabaseToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func putDatabaseToken(tx *bolt.Tx, token *DatabaseToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte("tokens")).Put([]byte("token--"+token.ID), data)
+}
+
+// findDatabaseToken returns the active token matching the given plain token and records its usage.
+func findDatabaseToken(plain string) *DatabaseToken {
+	if plain == "" {
+		return nil
+	}
+
+	hash := databaseTokenHash(plain)
+	now := time.Now()
+
+	var found *DatabaseToken
+	err := app.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket([]byte("tokens")).Get([]byte("hash--" + hash))
+		if id == nil {
+			return nil
+		}
+
+		token, err := getDatabaseToken(tx, string(id))
+		if err != nil || token == nil || !token.IsActive(now) {
+			return err
+		}
+
+		found = token
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithError(err).Error("cannot look up token")
+		return nil
+	}
+
+	if found != nil && (found.LastUsedAt == nil || now.Sub(*found.LastUsedAt) > tokenLastUsedInterval) {
+		err := app.db.Update(func(tx *bolt.Tx) error {
+			token, err := getDatabaseToken(tx, found.ID)
+			if err != nil || token == nil {
+				return err
+			}
+
+			token.LastUsedAt = &now
+
+			return putDatabaseToken(tx, token)
+		})
+
+		if err != nil {
+			log.WithField("token", found.ID).WithError(err).Error("cannot update last usage of token")
+		}
+	}
+
+	return found
+}
+
+func createDatabaseToken(request DatabaseTokenRequest) (*DatabaseToken, string, error) {
+	id, err := generateToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	plain, err := generateToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if request.Rules == nil {
+		request.Rules = make([]ConfigUserRule, 0)
+	}
+
+	token := &DatabaseToken{
+		ID:         id[:16],
+		Name:       request.Name,
+		TokenHash:  databaseTokenHash(plain),
+		CreatedAt:  time.Now(),
+		ExpiresAt:  request.ExpiresAt,
+		Rules:      request.Rules,
+		Scopes:     request.Scopes,
+		AllowedIPs: request.AllowedIPs,
+	}
+
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("tokens")).Put([]byte("hash--"+token.TokenHash), []byte(token.ID)); err != nil {
+			return err
+		}
+
+		return putDatabaseToken(tx, token)
+	})
+
+	forgetTokenCount()
+
+	return token, plain, err
+}
+
+func listDatabaseTokens() ([]DatabaseToken, error) {
+	tokens := make([]DatabaseToken, 0)
+
+	err := app.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("tokens")).Cursor()
+
+		prefix := []byte("token--")
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var token DatabaseToken
+
+			if err := json.Unmarshal(v, &token); err != nil {
+				return err
+			}
+
+			tokens = append(tokens, token)
+		}
+
+		return nil
+	})
+
+	return tokens, err
+}
+
+func revokeDatabaseToken(id string) (*DatabaseToken, error) {
+	var token *DatabaseToken
+
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		token, err = getDatabaseToken(tx, id)
+		if err != nil || token == nil {
+			return err
+		}
+
+		if token.RevokedAt == nil {
+			now := time.Now()
+			token.RevokedAt = &now
+		}
+
+		if err := tx.Bucket([]byte("tokens")).Delete([]byte("hash--" + token.TokenHash)); err != nil {
+			return err
+		}
+
+		return putDatabaseToken(tx, token)
+	})
+
+	tokenUsers.Delete(id)
+
+	return token, err
+}
+
+// rotateDatabaseToken replaces the secret of a token, the previous secret stops working immediately.
+func rotateDatabaseToken(id string) (*DatabaseToken, string, error) {
+	plain, err := generateToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var token *DatabaseToken
+
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		token, err = getDatabaseToken(tx, id)
+		if err != nil || token == nil {
+			return err
+		}
+
+		if token.RevokedAt != nil {
+			return fmt.Errorf("token %s is revoked", id)
+		}
+
+		bucket := tx.Bucket([]byte("tokens"))
+
+		if err := bucket.Delete([]byte("hash--" + token.TokenHash)); err != nil {
+			return err
+		}
+
+		token.TokenHash = databaseTokenHash(plain)
+
+		if err := bucket.Put([]byte("hash--"+token.TokenHash), []byte(token.ID)); err != nil {
+			return err
+		}
+
+		return putDatabaseToken(tx, token)
+	})
+
+	return token, plain, err
+}
+
+func registerTokenHandlers(router *Router) {
+	router.GET("/admin/tokens", audited("admin", throttledAuth(listTokensHandler)))
+	router.POST("/admin/tokens", audited("admin", throttledAuth(createTokenHandler)))
+	router.DELETE("/admin/tokens/:id", audited("admin", throttledAuth(revokeTokenHandler)))
+	router.POST("/admin/tokens/:id/rotate", audited("admin", throttledAuth(rotateTokenHandler)))
+}
+
+func writeTokenResponse(w http.ResponseWriter, status int, token *DatabaseToken, plain string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	response := map[string]interface{}{"data": token}
+	if plain != "" {
+		response["token"] = plain
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func listTokensHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !validateAdminRequest(r) {
+		unauthorized(w)
+		return
+	}
+
+	tokens, err := listDatabaseTokens()
+	if err != nil {
+		log.WithContext(r.Context()).Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": tokens})
+}
+
+func createTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !validateAdminRequest(r) {
+		unauthorized(w)
+		return
+	}
+
+	var request DatabaseTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := compileRules(request.Rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateScopes(request.Scopes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := parseNetworks(request.AllowedIPs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, plain, err := createDatabaseToken(request)
+	if err != nil {
+		log.WithContext(r.Context()).Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"token": token.ID, "name": token.Name}).Info("created token")
+	auditTarget(r, token.ID)
+
+	writeTokenResponse(w, http.StatusCreated, token, plain)
+}
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !validateAdminRequest(r) {
+		unauthorized(w)
+		return
+	}
+
+	token, err := revokeDatabaseToken(ps.ByName("id"))
+	if err != nil {
+		log.WithContext(r.Context()).Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if token == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"token": token.ID, "name": token.Name}).Info("revoked token")
+
+	writeTokenResponse(w, http.StatusOK, token, "")
+}
+
+func rotateTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !validateAdminRequest(r) {
+		unauthorized(w)
+		return
+	}
+
+	token, plain, err := rotateDatabaseToken(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if token == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"token": token.ID, "name": token.Name}).Info("rotated token")
+
+	writeTokenResponse(w, http.StatusOK, token, plain)
+}
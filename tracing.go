@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The global tracer provider is a no-op until tracing is configured, so spans cost nothing by default.
+var tracer = otel.Tracer("github.com/shyim/composer-registry")
+
+// setupTracing installs the configured exporter and returns a function flushing the pending spans.
+func setupTracing(config ConfigTracing) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch config.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		options := []otlptracehttp.Option{}
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(config.Endpoint))
+		}
+
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", config.Exporter)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "composer-registry"
+	}
+
+	sampleRatio := 1.0
+	if config.SampleRatio != nil {
+		sampleRatio = *config.SampleRatio
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// tracedHandler starts a span per request, instrumented renames it by the route once the request is routed,
+// e.g. GET /p/:owner/:repo/versions.json.
+func tracedHandler(handler http.Handler) http.Handler {
+	return otelhttp.NewHandler(handler, "http", otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+		return r.Method
+	}))
+}
+
+// tracedHTTPClient returns a client whose requests to forges are recorded as spans of the calling context.
+func tracedHTTPClient(base *http.Client) *http.Client {
+	transport := base.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	client := *base
+	client.Transport = otelhttp.NewTransport(transport)
+
+	return &client
+}
+
+// endSpan records the error of the traced operation and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+func tracedView(ctx context.Context, name string, fn func(*bolt.Tx) error) error {
+	_, span := tracer.Start(ctx, "bbolt.View "+name)
+	err := app.db.View(fn)
+	endSpan(span, err)
+
+	return err
+}
+
+func tracedUpdate(ctx context.Context, name string, fn func(*bolt.Tx) error) error {
+	_, span := tracer.Start(ctx, "bbolt.Update "+name)
+	err := app.db.Update(fn)
+	endSpan(span, err)
+
+	return err
+}
+
+func tracedBatch(ctx context.Context, name string, fn func(*bolt.Tx) error) error {
+	_, span := tracer.Start(ctx, "bbolt.Batch "+name)
+	err := app.db.Batch(fn)
+	endSpan(span, err)
+
+	return err
+}
+
+// startProviderSpan starts the span of a sync or webhook of a provider.
+func startProviderSpan(ctx context.Context, name, provider, project string) (context.Context, trace.Span) {
+	attributes := []attribute.KeyValue{attribute.String("provider", provider)}
+	if project != "" {
+		attributes = append(attributes, attribute.String("project", project))
+	}
+
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
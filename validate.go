@@ -0,0 +1,380 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigProblem is a problem of the config, Path uses the property names of config-schema.json, e.g.
+// providers[1].cron_schedule. Warnings are logged, the registry does not start with errors.
+type ConfigProblem struct {
+	Path    string
+	Message string
+	Warning bool
+}
+
+func (p ConfigProblem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+
+	return p.Path + ": " + p.Message
+}
+
+// ConfigProblems is returned by LoadConfig when the config has errors.
+type ConfigProblems []ConfigProblem
+
+func (p ConfigProblems) Error() string {
+	messages := make([]string, 0, len(p))
+	for _, problem := range p {
+		messages = append(messages, problem.String())
+	}
+
+	return "config: " + strings.Join(messages, "; ")
+}
+
+func (p ConfigProblems) errors() ConfigProblems {
+	var errors ConfigProblems
+	for _, problem := range p {
+		if !problem.Warning {
+			errors = append(errors, problem)
+		}
+	}
+
+	return errors
+}
+
+func (p *ConfigProblems) add(path string, format string, args ...interface{}) {
+	*p = append(*p, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *ConfigProblems) warn(path string, format string, args ...interface{}) {
+	*p = append(*p, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// validateConfig checks the whole config and compiles rules and networks, all problems are returned instead
+// of only the first one.
+func validateConfig(config *Config) ConfigProblems {
+	var problems ConfigProblems
+	var err error
+
+	if config.URL == "" {
+		problems.warn("base_url", "is not set, defaulting to http://localhost:8080")
+	}
+
+	providerNames := make(map[string]int)
+	customProviders := 0
+
+	for i, provider := range config.Providers {
+		path := fmt.Sprintf("providers[%d]", i)
+
+		if provider.Name == "" {
+			problems.add(path+".name", "is required")
+		} else if first, ok := providerNames[provider.Name]; ok {
+			problems.add(path+".name", "%q is already used by providers[%d]", provider.Name, first)
+		} else {
+			providerNames[provider.Name] = i
+		}
+
+		switch provider.Type {
+		case "github", "gitlab":
+			for j, project := range provider.Projects {
+				if project.Name == "" {
+					problems.add(fmt.Sprintf("%s.projects[%d].name", path, j), "is required")
+				} else if provider.Type == "github" && strings.Count(project.Name, "/") != 1 {
+					problems.add(fmt.Sprintf("%s.projects[%d].name", path, j), "%q must be owner/repository", project.Name)
+				} else if provider.Type == "gitlab" && !strings.Contains(project.Name, "/") {
+					problems.add(fmt.Sprintf("%s.projects[%d].name", path, j), "%q must be namespace/project", project.Name)
+				}
+			}
+		case "shopware":
+			for j, project := range provider.Projects {
+				if project.Name == "" {
+					problems.add(fmt.Sprintf("%s.projects[%d].name", path, j), "is required")
+				}
+			}
+		case "custom":
+			if customProviders++; customProviders > 1 {
+				problems.warn(path, "only the first custom provider receives published packages")
+			}
+
+			hasSecret := provider.WebhookSecret != "" || provider.WebhookSecretHash != ""
+			if provider.AllowSecretPublish && hasSecret {
+				problems.warn(path+".allow_secret_publish", "is deprecated, the webhook_secret may change every package, use users with the publish and delete scopes")
+			} else if provider.AllowSecretPublish {
+				problems.add(path+".allow_secret_publish", "requires webhook_secret or webhook_secret_hash")
+			} else if hasSecret {
+				problems.warn(path+".webhook_secret", "cannot publish without allow_secret_publish, use users with the publish and delete scopes")
+			}
+		case "":
+			problems.add(path+".type", "is required")
+		default:
+			problems.add(path+".type", "unknown type %q, expected github, gitlab, shopware or custom", provider.Type)
+		}
+
+		if provider.CronSchedule != "" {
+			if _, err := cron.ParseStandard(provider.CronSchedule); err != nil {
+				problems.add(path+".cron_schedule", "invalid cron expression %q: %s", provider.CronSchedule, err)
+			}
+		}
+
+		if provider.Type == "github" && provider.WebhookSecretHash != "" {
+			problems.add(path+".webhook_secret_hash", "is not supported by github providers, the signature of a delivery requires the plain webhook_secret")
+		} else if provider.WebhookSecret != "" && provider.WebhookSecretHash != "" {
+			problems.warn(path, "webhook_secret is ignored, webhook_secret_hash is used")
+		}
+
+		if config.Providers[i].allowedNetworks, err = parseNetworks(provider.AllowedIPs); err != nil {
+			problems.add(path+".allowed_ips", "%s", err)
+		}
+
+		if provider.AllowedIPsFile != "" {
+			networks, err := loadNetworksFile(provider.AllowedIPsFile)
+			if err != nil {
+				problems.add(path+".allowed_ips_file", "%s", err)
+			}
+
+			config.Providers[i].allowedNetworks = append(config.Providers[i].allowedNetworks, networks...)
+		}
+	}
+
+	for i, user := range config.Users {
+		path := fmt.Sprintf("users[%d]", i)
+
+		if err := compileRules(user.Rules); err != nil {
+			problems.add(path+"."+ruleErrorPath(err), "%s", ruleErrorMessage(err))
+		}
+
+		if err := compileRules(user.PublishRules); err != nil {
+			problems.add(path+".publish_"+ruleErrorPath(err), "%s", ruleErrorMessage(err))
+		}
+
+		if err := validateScopes(user.Scopes); err != nil {
+			problems.add(path+".scopes", "%s", err)
+		}
+
+		if config.Users[i].allowedNetworks, err = parseNetworks(user.AllowedIPs); err != nil {
+			problems.add(path+".allowed_ips", "%s", err)
+		}
+
+		if err := validateClientCertificates(user.ClientCertificates); err != nil {
+			problems.add(path+".client_certificates", "%s", err)
+		}
+
+		if user.Password != "" && user.PasswordHash != "" {
+			problems.warn(path, "password is ignored, password_hash is used")
+		}
+
+		if user.Token == "" && user.TokenHash == "" && user.Password == "" && user.PasswordHash == "" && len(user.ClientCertificates) == 0 {
+			problems.warn(path, "has no token, token_hash, password, password_hash or client_certificates and cannot authenticate")
+		}
+	}
+
+	for i, issuer := range config.OIDC {
+		path := fmt.Sprintf("oidc[%d]", i)
+
+		if issuer.Issuer == "" {
+			problems.add(path+".issuer", "is required")
+		}
+
+		if issuer.Audience == "" {
+			problems.add(path+".audience", "is required")
+		}
+
+		if issuer.JWKSFile == "" && issuer.JWKSURL == "" {
+			problems.add(path, "requires jwks_file or jwks_url")
+		}
+
+		for j, mapping := range issuer.Mappings {
+			mappingPath := fmt.Sprintf("%s.mappings[%d]", path, j)
+
+			if mapping.Claim == "" {
+				problems.add(mappingPath+".claim", "is required")
+			}
+
+			if err := compileRules(mapping.Rules); err != nil {
+				problems.add(mappingPath+"."+ruleErrorPath(err), "%s", ruleErrorMessage(err))
+			}
+
+			if err := compileRules(mapping.PublishRules); err != nil {
+				problems.add(mappingPath+".publish_"+ruleErrorPath(err), "%s", ruleErrorMessage(err))
+			}
+
+			if err := validateScopes(mapping.Scopes); err != nil {
+				problems.add(mappingPath+".scopes", "%s", err)
+			}
+		}
+	}
+
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		problems.add("tls", "requires cert_file and key_file")
+	}
+
+	if config.TLS.ClientCAFile != "" && config.TLS.CertFile == "" {
+		problems.add("tls.client_ca_file", "requires cert_file and key_file")
+	}
+
+	if config.trustedProxies, err = parseNetworks(config.TrustedProxies); err != nil {
+		problems.add("trusted_proxies", "%s", err)
+	}
+
+	if config.Tracing.Exporter != "" && config.Tracing.Exporter != "otlp" && config.Tracing.Exporter != "stdout" {
+		problems.add("tracing.exporter", "must be otlp or stdout")
+	}
+
+	if ratio := config.Tracing.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		problems.add("tracing.sample_ratio", "must be between 0 and 1")
+	}
+
+	if _, err := log.ParseLevel(config.Log.Level); config.Log.Level != "" && err != nil {
+		problems.add("log.level", "%s", err)
+	}
+
+	if config.Log.Format != "" && config.Log.Format != "text" && config.Log.Format != "json" {
+		problems.add("log.format", "must be text or json")
+	}
+
+	if config.Log.AccessLog != "" && config.Log.AccessLog != "json" && config.Log.AccessLog != "combined" {
+		problems.add("log.access_log", "must be json or combined")
+	}
+
+	if config.ShutdownTimeout < 0 {
+		problems.add("shutdown_timeout", "must not be negative")
+	}
+
+	if config.Audit.RetentionDays < 0 {
+		problems.add("audit.retention_days", "must not be negative")
+	}
+
+	return problems
+}
+
+// ruleErrorPath returns the rules[i] prefix of an error of compileRules.
+func ruleErrorPath(err error) string {
+	path, _, _ := strings.Cut(err.Error(), ": ")
+
+	return path
+}
+
+func ruleErrorMessage(err error) string {
+	_, message, _ := strings.Cut(err.Error(), ": ")
+
+	return message
+}
+
+// configFields returns the types of the fields of a config struct by their property names.
+func configFields(typ reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < typ.NumField(); i++ {
+		if name, _, _ := strings.Cut(typ.Field(i).Tag.Get("yaml"), ","); name != "" {
+			fields[name] = typ.Field(i).Type
+		}
+	}
+
+	return fields
+}
+
+// unknownProperties reports properties the config struct does not have, they are ignored when the config is
+// decoded and usually are typos.
+func unknownProperties(value interface{}, typ reflect.Type, path string) ConfigProblems {
+	var problems ConfigProblems
+
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		properties, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		fields := configFields(typ)
+
+		names := make([]string, 0, len(properties))
+		for name := range properties {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			propertyPath := name
+			if path != "" {
+				propertyPath = path + "." + name
+			}
+
+			fieldType, ok := fields[name]
+			if !ok {
+				if path != "" || name != "$schema" {
+					problems.add(propertyPath, "unknown property")
+				}
+
+				continue
+			}
+
+			problems = append(problems, unknownProperties(properties[name], fieldType, propertyPath)...)
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+
+		for i, item := range items {
+			problems = append(problems, unknownProperties(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+
+	return problems
+}
+
+// runValidate checks the config file and prints all problems, it fails when the registry would not start.
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	_, problems, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range problems {
+		if problem.Warning {
+			fmt.Printf("warning: %s\n", problem)
+		} else {
+			fmt.Printf("error:   %s\n", problem)
+		}
+	}
+
+	if errors := problems.errors(); len(errors) > 0 {
+		return fmt.Errorf("%s has %d errors", configFile, len(errors))
+	}
+
+	fmt.Printf("%s is valid\n", configFile)
+
+	return nil
+}
+
+func exitOnConfigError(err error) {
+	if problems, ok := err.(ConfigProblems); ok {
+		for _, problem := range problems {
+			log.WithField("path", problem.Path).Error("config: " + problem.Message)
+		}
+
+		os.Exit(1)
+	}
+
+	log.Fatalln(err)
+}
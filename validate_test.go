@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestUnknownProperties(t *testing.T) {
+	var value interface{}
+	err := json.Unmarshal([]byte(`{
+		"$schema": "config-schema.json",
+		"metrics": {"enabeld": true},
+		"tls": {"cert": "server.pem"},
+		"users": [{"token": "a", "alowed_ips": ["10.0.0.0/8"]}],
+		"providers": [{"name": "custom", "type": "custom", "tokn": "x"}],
+		"unknown": 1
+	}`), &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ConfigProblems{
+		{Path: "metrics.enabeld", Message: "unknown property"},
+		{Path: "providers[0].tokn", Message: "unknown property"},
+		{Path: "tls.cert", Message: "unknown property"},
+		{Path: "unknown", Message: "unknown property"},
+		{Path: "users[0].alowed_ips", Message: "unknown property"},
+	}
+
+	if got := unknownProperties(value, reflect.TypeOf(Config{}), ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("unknownProperties() = %v, want %v", got, want)
+	}
+}
+
+func TestValidateConfigGithubWebhookSecretHash(t *testing.T) {
+	config := &Config{
+		URL: "http://localhost",
+		Providers: []ConfigProvider{
+			{Name: "github", Type: "github", WebhookSecretHash: "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+			{Name: "gitlab", Type: "gitlab", WebhookSecretHash: "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+		},
+	}
+
+	problems := validateConfig(config).errors()
+	if len(problems) != 1 || problems[0].Path != "providers[0].webhook_secret_hash" {
+		t.Errorf("expected an error for the github provider only, got %v", problems)
+	}
+}
@@ -1,20 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
-func addOrUpdateVersion(tx *bolt.Tx, bytes []byte, version, downloadLink, infoKey string) error {
+func addOrUpdateVersion(tx *bolt.Tx, bytes []byte, version, downloadLink, infoKey, providerName string, released time.Time) error {
 	composerJson := map[string]interface{}{}
 
 	if err := json.Unmarshal(bytes, &composerJson); err != nil {
 		return err
 	}
 
-	return addOrUpdateVersionDirect(tx, composerJson, downloadLink, version, infoKey)
+	return addOrUpdateVersionDirect(tx, composerJson, downloadLink, version, infoKey, providerName, released)
 }
 
 func deleteVersion(tx *bolt.Tx, saveTag string) error {
@@ -38,10 +41,72 @@ func deleteVersion(tx *bolt.Tx, saveTag string) error {
 		return err
 	}
 
-	return nil
+	nameAndVersion := strings.SplitN(strings.TrimPrefix(string(versionKey), "packages--"), "|", 2)
+
+	if err := bucket.Delete([]byte("dist--" + nameAndVersion[0] + "|" + nameAndVersion[1])); err != nil {
+		return err
+	}
+
+	if err := reindexPackage(tx, nameAndVersion[0]); err != nil {
+		return err
+	}
+
+	// the package is gone once its last version is deleted
+	if !packageHasVersions(tx, nameAndVersion[0]) {
+		if err := removePackageProvider(tx, nameAndVersion[0]); err != nil {
+			return err
+		}
+	}
+
+	return recordChange(tx, nameAndVersion[0], nameAndVersion[1])
 }
 
-func addOrUpdateVersionDirect(tx *bolt.Tx, composerJson map[string]interface{}, downloadLink, version, infoKey string) error {
+// versionReleaseTime returns the release date of a stored version, or the zero time when it is unknown.
+func versionReleaseTime(composerJson map[string]interface{}) time.Time {
+	value, _ := composerJson["time"].(string)
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", time.DateOnly} {
+		if released, err := time.Parse(layout, value); err == nil {
+			return released
+		}
+	}
+
+	return time.Time{}
+}
+
+// storedReleaseTime returns the release date of the version stored under infoKey when its dist URL contains
+// ref, so syncs do not fetch the date of an unchanged commit again. The zero time is returned otherwise.
+func storedReleaseTime(tx *bolt.Tx, infoKey, ref string) time.Time {
+	bucket := tx.Bucket([]byte("packages"))
+
+	key := bucket.Get([]byte("info--" + infoKey))
+	if key == nil {
+		return time.Time{}
+	}
+
+	stored := map[string]interface{}{}
+	if err := json.Unmarshal(bucket.Get(key), &stored); err != nil {
+		return time.Time{}
+	}
+
+	dist, _ := stored["dist"].(map[string]interface{})
+	if url, _ := dist["url"].(string); !strings.Contains(url, ref) {
+		return time.Time{}
+	}
+
+	return versionReleaseTime(stored)
+}
+
+func packageHasVersions(tx *bolt.Tx, packageName string) bool {
+	prefix := []byte("packages--" + packageName + "|")
+	k, _ := tx.Bucket([]byte("packages")).Cursor().Seek(prefix)
+
+	return k != nil && bytes.HasPrefix(k, prefix)
+}
+
+// addOrUpdateVersionDirect stores a version. Without a time in the composer.json, released is used, which is
+// the commit date for Git providers. Versions without either have an unknown release date.
+func addOrUpdateVersionDirect(tx *bolt.Tx, composerJson map[string]interface{}, downloadLink, version, infoKey, providerName string, released time.Time) error {
 	packageName := composerJson["name"].(string)
 
 	composerJson["dist"] = map[string]string{
@@ -55,11 +120,32 @@ func addOrUpdateVersionDirect(tx *bolt.Tx, composerJson map[string]interface{},
 
 	bucket := tx.Bucket([]byte("packages"))
 
+	if _, ok := composerJson["time"]; !ok && !released.IsZero() {
+		composerJson["time"] = released.UTC().Format(time.RFC3339)
+	}
+
 	if err := bucket.Put([]byte("info--"+infoKey), []byte(key)); err != nil {
 		return err
 	}
 
+	if err := setPackageProvider(tx, packageName, providerName); err != nil {
+		return err
+	}
+
 	composerJsonData, _ := json.Marshal(composerJson)
 
-	return bucket.Put([]byte(key), composerJsonData)
+	// periodic syncs rewrite every version, only real changes should end up in the change log
+	if bytes.Equal(bucket.Get([]byte(key)), composerJsonData) {
+		return nil
+	}
+
+	if err := bucket.Put([]byte(key), composerJsonData); err != nil {
+		return err
+	}
+
+	if err := updateSearchIndex(tx, composerJson, version); err != nil {
+		return err
+	}
+
+	return recordChange(tx, packageName, version)
 }